@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	cniTypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/version"
+	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
+	"test-cni/ipam"
+	"test-cni/plugin"
+	"test-cni/skel"
+	"test-cni/utils"
+)
+
+// ipamLogPath 没有配置log.path时的日志文件，和test-cni分开，两个进程不会同时轮转同一个文件
+const ipamLogPath = "/root/testcni-ipam.log"
+
+// testcni-ipam 把test-cni内置的分配器作为独立的ipam插件，
+// 给macvlan、ipvlan、bridge等插件分配ip，和test-cni共用节点上的ip存储和锁
+func main() {
+	utils.SetDefaultLogPath(ipamLogPath)
+	ipam.InitStorage()
+	skel.PluginMainFuncs(skel.CNIFuncs{
+		Add:    cmdAdd,
+		Del:    cmdDel,
+		Check:  cmdCheck,
+		GC:     cmdGC,
+		Status: cmdStatus,
+	}, version.All, bv.BuildString("testcni-ipam"))
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	plugin.SetLogFields("ADD", args)
+	ipamConfig := plugin.GetIpamConfigs(args)
+	if ipamConfig == nil {
+		errMsg := fmt.Errorf("add: get ipam config error, config: %s", string(args.StdinData))
+		utils.LogError(errMsg.Error())
+		return errMsg
+	}
+	utils.InitLog(ipamConfig.Log)
+	ipamConfig.SetPodLogFields()
+
+	res, err := plugin.IpamAdd(args, ipamConfig)
+	if err != nil {
+		utils.LogError("IpamAdd error", "error", err.Error())
+		return err
+	}
+
+	utils.LogInfo("add ok", "ips", res.IPs)
+	_ = cniTypes.PrintResult(res, ipamConfig.CNIVersion)
+	return nil
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	plugin.SetLogFields("DEL", args)
+	ipamConfig := plugin.GetIpamConfigs(args)
+	if ipamConfig == nil {
+		errMsg := fmt.Errorf("del: get ipam config error, config: %s", string(args.StdinData))
+		utils.LogError(errMsg.Error())
+		return errMsg
+	}
+	utils.InitLog(ipamConfig.Log)
+	ipamConfig.SetPodLogFields()
+
+	err := plugin.IpamDel(args, ipamConfig)
+	if err != nil {
+		utils.LogError("IpamDel error", "error", err.Error())
+		return err
+	}
+	return nil
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	plugin.SetLogFields("CHECK", args)
+	ipamConfig := plugin.GetIpamConfigs(args)
+	if ipamConfig == nil {
+		errMsg := fmt.Errorf("check: get ipam config error, config: %s", string(args.StdinData))
+		utils.LogError(errMsg.Error())
+		return errMsg
+	}
+	utils.InitLog(ipamConfig.Log)
+	ipamConfig.SetPodLogFields()
+
+	err := plugin.IpamCheck(args, ipamConfig)
+	if err != nil {
+		utils.LogError("IpamCheck error", "error", err.Error())
+		return err
+	}
+	return nil
+}
+
+func cmdGC(args *skel.CmdArgs) error {
+	plugin.SetLogFields("GC", args)
+	ipamConfig := plugin.GetIpamConfigs(args)
+	if ipamConfig == nil {
+		errMsg := fmt.Errorf("gc: get ipam config error, config: %s", string(args.StdinData))
+		utils.LogError(errMsg.Error())
+		return errMsg
+	}
+	utils.InitLog(ipamConfig.Log)
+
+	err := plugin.IpamGC(args, ipamConfig)
+	if err != nil {
+		utils.LogError("IpamGC error", "error", err.Error())
+		return err
+	}
+	return nil
+}
+
+func cmdStatus(args *skel.CmdArgs) error {
+	plugin.SetLogFields("STATUS", args)
+	ipamConfig := plugin.GetIpamConfigs(args)
+	if ipamConfig == nil {
+		errMsg := fmt.Errorf("status: get ipam config error, config: %s", string(args.StdinData))
+		utils.LogError(errMsg.Error())
+		return errMsg
+	}
+	utils.InitLog(ipamConfig.Log)
+
+	err := plugin.IpamStatus(args, ipamConfig)
+	if err != nil {
+		utils.LogError("IpamStatus error", "error", err.Error())
+		return err
+	}
+	return nil
+}
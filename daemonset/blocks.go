@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"math/big"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"test-cni/ipam"
+	"test-cni/utils"
+)
+
+// cluster模式下地址块的分配表放在daemonset所在命名空间的ConfigMap中，
+// 每个节点的daemonset通过乐观锁（resourceVersion）给自己申请、释放地址块，并回收已删除节点的地址块
+const (
+	blockConfigMapName = "testcni-ipam-blocks"
+	blocksKey          = "blocks"
+	namespaceFile      = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// blockOwner 地址块属于哪个节点，Primary是节点的第一个地址块，vxlan设备的地址在里面，节点存在期间不释放
+type blockOwner struct {
+	Node    string `json:"node"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type blockManager struct {
+	clientSet kubernetes.Interface
+	namespace string
+	nodeName  string
+	config    *dsConfig
+	//本节点的主地址块，每个地址族一个
+	primary []string
+}
+
+func newBlockManager(clientSet kubernetes.Interface, nodeName string, config *dsConfig) (*blockManager, error) {
+	b, err := os.ReadFile(namespaceFile)
+	if err != nil {
+		return nil, fmt.Errorf("read namespace file error:%s", err.Error())
+	}
+	return &blockManager{
+		clientSet: clientSet,
+		namespace: strings.TrimSpace(string(b)),
+		nodeName:  nodeName,
+		config:    config,
+	}, nil
+}
+
+// start 确保本节点每个地址族都有主地址块，返回主地址块和本节点所有的地址块
+func (m *blockManager) start() ([]string, []string, error) {
+	blocks, err := m.update(func(blocks map[string]*blockOwner) error {
+		for _, clusterCidr := range m.config.ClusterCidrs {
+			isV6 := ipam.IsIPv6Cidr(clusterCidr)
+			if m.primaryOf(blocks, isV6) != "" {
+				continue
+			}
+			cidr, err := freeBlock(clusterCidr, m.config.blockSize(isV6), blocks, m.config.IpamExclude)
+			if err != nil {
+				return err
+			}
+			blocks[cidr] = &blockOwner{Node: m.nodeName, Primary: true}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	m.primary = nil
+	for _, clusterCidr := range m.config.ClusterCidrs {
+		m.primary = append(m.primary, m.primaryOf(blocks, ipam.IsIPv6Cidr(clusterCidr)))
+	}
+	return m.primary, m.nodeBlocks(blocks), nil
+}
+
+// sync 按使用情况申请或释放本节点的地址块，并回收已经不存在的节点的地址块，返回本节点现在的地址块
+// 释放之前先通过writeConfig把地址块从cni配置中去掉，避免插件在释放过程中从这个块分配ip
+func (m *blockManager) sync(nodeExists func(string) bool, writeConfig func([]string) error) ([]string, error) {
+	_, blocks, err := m.load()
+	if err != nil {
+		return nil, err
+	}
+	release, claim, err := m.plan(m.nodeBlocks(blocks), writeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks, err = m.update(func(blocks map[string]*blockOwner) error {
+		for cidr, owner := range blocks {
+			if owner.Node == m.nodeName {
+				if release[cidr] {
+					delete(blocks, cidr)
+				}
+				continue
+			}
+			if !nodeExists(owner.Node) {
+				delete(blocks, cidr)
+				fmt.Println(fmt.Sprintf("blocks: release %s of deleted node %s", cidr, owner.Node))
+			}
+		}
+		//分配表被误删时把主地址块补回去，vxlan设备的地址还在用
+		for _, cidr := range m.primary {
+			if _, ok := blocks[cidr]; !ok {
+				blocks[cidr] = &blockOwner{Node: m.nodeName, Primary: true}
+			}
+		}
+		for _, clusterCidr := range claim {
+			cidr, err := freeBlock(clusterCidr, m.config.blockSize(ipam.IsIPv6Cidr(clusterCidr)), blocks, m.config.IpamExclude)
+			if err != nil {
+				return err
+			}
+			blocks[cidr] = &blockOwner{Node: m.nodeName}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for cidr := range release {
+		fmt.Println(fmt.Sprintf("blocks: released empty block %s", cidr))
+	}
+	return m.nodeBlocks(blocks), nil
+}
+
+// blockUsage 本节点一个地址块的使用情况，free不包括quarantine中的ip
+type blockUsage struct {
+	cidr     string
+	capacity int
+	free     int
+	//没有分配出去的ip，也没有quarantine中的ip，释放之后其他节点可以马上使用
+	empty bool
+}
+
+// plan 在ipam锁内统计本节点地址块的使用情况，决定释放和申请哪些地址块
+// 要释放的地址块在锁内从本节点的地址块列表和cni配置中去掉，之后拿到锁的ADD不会再从中分配
+func (m *blockManager) plan(owned []string, writeConfig func([]string) error) (map[string]bool, []string, error) {
+	lock, err := utils.AcquireLock(gcLockTimeout)
+	if err != nil {
+		return nil, nil, fmt.Errorf("AcquireLock error:%s", err.Error())
+	}
+	defer lock.Release()
+
+	var usage []*blockUsage
+	for _, cidr := range owned {
+		r := &ipam.Range{Subnet: cidr, Exclude: nodeExclude([]string{cidr}, m.config.IpamExclude)}
+		capacity, used, quarantined, err := ipam.BlockUsage(r, m.config.IpQuarantine)
+		if err != nil {
+			return nil, nil, fmt.Errorf("get usage of block %s error:%s", cidr, err.Error())
+		}
+		free := capacity - used - quarantined
+		if free < 0 {
+			free = 0
+		}
+		usage = append(usage, &blockUsage{cidr: cidr, capacity: capacity, free: free, empty: used == 0 && quarantined == 0})
+	}
+
+	release, claim := planBlocks(usage, m.primary, m.config.ClusterCidrs)
+	if len(release) > 0 {
+		var remaining []string
+		for _, cidr := range owned {
+			if !release[cidr] {
+				remaining = append(remaining, cidr)
+			}
+		}
+		if err = writeConfig(remaining); err != nil {
+			return nil, nil, err
+		}
+	}
+	return release, claim, nil
+}
+
+// planBlocks 每个地址族剩余的ip少于一个地址块的四分之一时申请新的块，
+// 空地址块释放之后剩余的ip仍然足够时释放，主地址块除外，排在后面的先释放
+func planBlocks(usage []*blockUsage, primary, clusterCidrs []string) (map[string]bool, []string) {
+	free := make(map[bool]int)
+	minFree := make(map[bool]int)
+	for _, u := range usage {
+		isV6 := ipam.IsIPv6Cidr(u.cidr)
+		free[isV6] += u.free
+		if u.capacity/4 > minFree[isV6] {
+			minFree[isV6] = u.capacity / 4
+		}
+	}
+
+	release := make(map[string]bool)
+	for i := len(usage) - 1; i >= 0; i-- {
+		u := usage[i]
+		if !u.empty || utils.StringsIn(primary, u.cidr) {
+			continue
+		}
+		isV6 := ipam.IsIPv6Cidr(u.cidr)
+		if free[isV6]-u.free >= minFree[isV6] {
+			release[u.cidr] = true
+			free[isV6] -= u.free
+		}
+	}
+
+	var claim []string
+	for _, clusterCidr := range clusterCidrs {
+		isV6 := ipam.IsIPv6Cidr(clusterCidr)
+		if free[isV6] < minFree[isV6] {
+			claim = append(claim, clusterCidr)
+		}
+	}
+	return release, claim
+}
+
+// load 读取分配表，ConfigMap不存在时返回空表
+func (m *blockManager) load() (*corev1.ConfigMap, map[string]*blockOwner, error) {
+	blocks := make(map[string]*blockOwner)
+	cm, err := m.clientSet.CoreV1().ConfigMaps(m.namespace).Get(context.TODO(), blockConfigMapName, v1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, blocks, nil
+		}
+		return nil, nil, fmt.Errorf("get configmap %s error:%s", blockConfigMapName, err.Error())
+	}
+	if v := cm.Data[blocksKey]; v != "" {
+		if err = json.Unmarshal([]byte(v), &blocks); err != nil {
+			return nil, nil, fmt.Errorf("configmap %s is not valid json:%s", blockConfigMapName, err.Error())
+		}
+	}
+	return cm, blocks, nil
+}
+
+// update 修改分配表并写回，其他节点同时修改导致冲突时重新读取再改一次
+func (m *blockManager) update(mutate func(blocks map[string]*blockOwner) error) (map[string]*blockOwner, error) {
+	var res map[string]*blockOwner
+	err := retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return errors.IsConflict(err) || errors.IsAlreadyExists(err)
+	}, func() error {
+		cm, blocks, err := m.load()
+		if err != nil {
+			return err
+		}
+		old := make(map[string]blockOwner)
+		for cidr, owner := range blocks {
+			old[cidr] = *owner
+		}
+		if err = mutate(blocks); err != nil {
+			return err
+		}
+		res = blocks
+
+		current := make(map[string]blockOwner)
+		for cidr, owner := range blocks {
+			current[cidr] = *owner
+		}
+		if cm != nil && reflect.DeepEqual(old, current) {
+			return nil
+		}
+		b, err := json.Marshal(blocks)
+		if err != nil {
+			return err
+		}
+		if cm == nil {
+			cm = &corev1.ConfigMap{ObjectMeta: v1.ObjectMeta{Name: blockConfigMapName, Namespace: m.namespace}}
+			cm.Data = map[string]string{blocksKey: string(b)}
+			_, err = m.clientSet.CoreV1().ConfigMaps(m.namespace).Create(context.TODO(), cm, v1.CreateOptions{})
+			return err
+		}
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		cm.Data[blocksKey] = string(b)
+		_, err = m.clientSet.CoreV1().ConfigMaps(m.namespace).Update(context.TODO(), cm, v1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("update configmap %s error:%s", blockConfigMapName, err.Error())
+	}
+	return res, nil
+}
+
+func (m *blockManager) primaryOf(blocks map[string]*blockOwner, isV6 bool) string {
+	for cidr, owner := range blocks {
+		if owner.Node == m.nodeName && owner.Primary && ipam.IsIPv6Cidr(cidr) == isV6 {
+			return cidr
+		}
+	}
+	return ""
+}
+
+// nodeBlocks 返回本节点的地址块，主地址块在前，其余按地址排序，插件按这个顺序选择
+func (m *blockManager) nodeBlocks(blocks map[string]*blockOwner) []string {
+	var res []string
+	for cidr, owner := range blocks {
+		if owner.Node == m.nodeName {
+			res = append(res, cidr)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		pi, pj := blocks[res[i]].Primary, blocks[res[j]].Primary
+		if pi != pj {
+			return pi
+		}
+		return bytes.Compare(ipam.CidrToIpNet(res[i]).IP.To16(), ipam.CidrToIpNet(res[j]).IP.To16()) < 0
+	})
+	return res
+}
+
+// freeBlock 在集群网段中按顺序找第一个和已有地址块都不重叠的块，整个块都被排除的跳过
+func freeBlock(clusterCidr string, prefix int, blocks map[string]*blockOwner, exclude []string) (string, error) {
+	_, clusterNet, err := net.ParseCIDR(clusterCidr)
+	if err != nil {
+		return "", fmt.Errorf("invalid cluster cidr:%s", clusterCidr)
+	}
+	ones, bits := clusterNet.Mask.Size()
+	var used, excluded []*net.IPNet
+	for cidr := range blocks {
+		if ipNet := ipam.CidrToIpNet(cidr); ipNet != nil {
+			used = append(used, ipNet)
+		}
+	}
+	for _, cidr := range exclude {
+		if ipNet := ipam.CidrToIpNet(cidr); ipNet != nil {
+			if exOnes, exBits := ipNet.Mask.Size(); exBits == bits && exOnes <= prefix {
+				excluded = append(excluded, ipNet)
+			}
+		}
+	}
+
+	step := new(big.Int).Lsh(big.NewInt(1), uint(bits-prefix))
+	count := new(big.Int).Lsh(big.NewInt(1), uint(prefix-ones))
+	cur := new(big.Int).SetBytes(clusterNet.IP)
+	for i := big.NewInt(0); i.Cmp(count) < 0; i.Add(i, big.NewInt(1)) {
+		ip := make(net.IP, len(clusterNet.IP))
+		cur.FillBytes(ip)
+		block := &net.IPNet{IP: ip, Mask: net.CIDRMask(prefix, bits)}
+		var overlap bool
+		for _, u := range used {
+			if u.Contains(block.IP) || block.Contains(u.IP) {
+				overlap = true
+				break
+			}
+		}
+		for _, ex := range excluded {
+			overlap = overlap || ex.Contains(block.IP)
+		}
+		if !overlap {
+			return block.String(), nil
+		}
+		cur.Add(cur, step)
+	}
+	return "", fmt.Errorf("no free /%d block in cluster cidr %s", prefix, clusterCidr)
+}
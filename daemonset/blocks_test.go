@@ -0,0 +1,161 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func owned(cidrs ...string) map[string]*blockOwner {
+	blocks := make(map[string]*blockOwner)
+	for _, cidr := range cidrs {
+		blocks[cidr] = &blockOwner{Node: "other"}
+	}
+	return blocks
+}
+
+func TestFreeBlock(t *testing.T) {
+	cases := []struct {
+		name        string
+		clusterCidr string
+		prefix      int
+		blocks      map[string]*blockOwner
+		exclude     []string
+		want        string
+		err         string
+	}{
+		{"first block", "10.244.0.0/24", 26, nil, nil, "10.244.0.0/26", ""},
+		{"skip used block", "10.244.0.0/24", 26, owned("10.244.0.0/26"), nil, "10.244.0.64/26", ""},
+		{"fill gap", "10.244.0.0/24", 26, owned("10.244.0.0/26", "10.244.0.128/26"), nil, "10.244.0.64/26", ""},
+		{"skip blocks inside a larger used block", "10.244.0.0/24", 26, owned("10.244.0.0/25"), nil, "10.244.0.128/26", ""},
+		{"skip block containing a smaller used block", "10.244.0.0/24", 26, owned("10.244.0.16/28"), nil, "10.244.0.64/26", ""},
+		{"cluster cidr not aligned", "10.244.0.77/24", 26, nil, nil, "10.244.0.0/26", ""},
+		{"cluster cidr is one block", "10.244.0.0/26", 26, nil, nil, "10.244.0.0/26", ""},
+		{"all used", "10.244.0.0/25", 26, owned("10.244.0.0/26", "10.244.0.64/26"), nil, "", "no free /26 block"},
+		{"skip block equal to exclude", "10.244.0.0/24", 26, nil, []string{"10.244.0.0/26"}, "10.244.0.64/26", ""},
+		{"skip blocks inside exclude", "10.244.0.0/24", 26, nil, []string{"10.244.0.0/25"}, "10.244.0.128/26", ""},
+		{"exclude larger than cluster cidr", "10.244.0.0/24", 26, nil, []string{"10.244.0.0/16"}, "", "no free /26 block"},
+		{"smaller exclude does not skip block", "10.244.0.0/24", 26, nil, []string{"10.244.0.16/28"}, "10.244.0.0/26", ""},
+		{"exclude of other family", "10.244.0.0/24", 26, nil, []string{"fd00::/8"}, "10.244.0.0/26", ""},
+		{"exclude and used", "10.244.0.0/24", 26, owned("10.244.0.64/26"), []string{"10.244.0.0/26"}, "10.244.0.128/26", ""},
+		{"v6", "fd00:10:244::/64", 122, nil, nil, "fd00:10:244::/122", ""},
+		{"v6 skip used", "fd00:10:244::/64", 122, owned("fd00:10:244::/122"), nil, "fd00:10:244::40/122", ""},
+		{"v6 skip exclude", "fd00:10:244::/64", 122, nil, []string{"fd00:10:244::/121"}, "fd00:10:244::80/122", ""},
+		{"invalid cluster cidr", "10.244.0.0", 26, nil, nil, "", "invalid cluster cidr"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			blocks := c.blocks
+			if blocks == nil {
+				blocks = make(map[string]*blockOwner)
+			}
+			got, err := freeBlock(c.clusterCidr, c.prefix, blocks, c.exclude)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("freeBlock() = %s, %v, want error %q", got, err, c.err)
+				}
+				return
+			}
+			if err != nil || got != c.want {
+				t.Fatalf("freeBlock() = %s, %v, want %s", got, err, c.want)
+			}
+		})
+	}
+}
+
+func TestNodeExclude(t *testing.T) {
+	cases := []struct {
+		name    string
+		cidrs   []string
+		exclude []string
+		want    []string
+	}{
+		{"inside", []string{"10.244.1.0/24"}, []string{"10.244.1.128/28"}, []string{"10.244.1.128/28"}},
+		{"other node", []string{"10.244.1.0/24"}, []string{"10.244.2.128/28"}, nil},
+		{"equal", []string{"10.244.1.0/24"}, []string{"10.244.1.0/24"}, []string{"10.244.1.0/24"}},
+		{"larger than subnet is clipped", []string{"10.244.1.0/26"}, []string{"10.244.1.0/24"}, []string{"10.244.1.0/26"}},
+		{"larger than several blocks", []string{"10.244.1.0/26", "10.244.1.64/26", "10.244.2.0/26"}, []string{"10.244.1.0/24"}, []string{"10.244.1.0/26", "10.244.1.64/26"}},
+		{"clipped once", []string{"10.244.1.0/26"}, []string{"10.244.1.0/24", "10.244.0.0/16"}, []string{"10.244.1.0/26"}},
+		{"other family", []string{"10.244.1.0/24"}, []string{"fd00::/8"}, nil},
+		{"v6 clipped", []string{"fd00::/122"}, []string{"fd00::/120"}, []string{"fd00::/122"}},
+		{"invalid", []string{"10.244.1.0/24"}, []string{"10.244.1.1"}, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := nodeExclude(c.cidrs, c.exclude)
+			if strings.Join(got, ",") != strings.Join(c.want, ",") {
+				t.Fatalf("nodeExclude() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestPlanBlocks(t *testing.T) {
+	const primary, primaryV6 = "10.244.0.0/26", "fd00::/122"
+	clusterCidrs := []string{"10.244.0.0/16", "fd00::/64"}
+	cases := []struct {
+		name    string
+		usage   []*blockUsage
+		release []string
+		claim   []string
+	}{
+		{"enough free ips", []*blockUsage{
+			{cidr: primary, capacity: 61, free: 30},
+		}, nil, nil},
+		{"exactly a quarter free", []*blockUsage{
+			{cidr: primary, capacity: 61, free: 15},
+		}, nil, nil},
+		{"less than a quarter free", []*blockUsage{
+			{cidr: primary, capacity: 61, free: 14},
+		}, nil, []string{"10.244.0.0/16"}},
+		{"quarantined ips are not free", []*blockUsage{
+			{cidr: primary, capacity: 61, free: 0},
+		}, nil, []string{"10.244.0.0/16"}},
+		{"empty block kept when needed", []*blockUsage{
+			{cidr: primary, capacity: 61, free: 5},
+			{cidr: "10.244.0.64/26", capacity: 61, free: 61, empty: true},
+		}, nil, nil},
+		{"empty block released", []*blockUsage{
+			{cidr: primary, capacity: 61, free: 20},
+			{cidr: "10.244.0.64/26", capacity: 61, free: 61, empty: true},
+		}, []string{"10.244.0.64/26"}, nil},
+		{"later block released first", []*blockUsage{
+			{cidr: primary, capacity: 61, free: 0},
+			{cidr: "10.244.0.64/26", capacity: 61, free: 61, empty: true},
+			{cidr: "10.244.0.128/26", capacity: 61, free: 61, empty: true},
+		}, []string{"10.244.0.128/26"}, nil},
+		{"block with quarantined ips not released", []*blockUsage{
+			{cidr: primary, capacity: 61, free: 40},
+			{cidr: "10.244.0.64/26", capacity: 61, free: 58},
+		}, nil, nil},
+		{"primary block never released", []*blockUsage{
+			{cidr: primary, capacity: 61, free: 61, empty: true},
+			{cidr: "10.244.0.64/26", capacity: 61, free: 50},
+		}, nil, nil},
+		{"dual stack claims per family", []*blockUsage{
+			{cidr: primary, capacity: 61, free: 40},
+			{cidr: primaryV6, capacity: 61, free: 3},
+		}, nil, []string{"fd00::/64"}},
+		{"dual stack releases per family", []*blockUsage{
+			{cidr: primary, capacity: 61, free: 2},
+			{cidr: primaryV6, capacity: 61, free: 30},
+			{cidr: "fd00::40/122", capacity: 61, free: 61, empty: true},
+		}, []string{"fd00::40/122"}, []string{"10.244.0.0/16"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			release, claim := planBlocks(c.usage, []string{primary, primaryV6}, clusterCidrs)
+			var released []string
+			for cidr := range release {
+				released = append(released, cidr)
+			}
+			sort.Strings(released)
+			if strings.Join(released, ",") != strings.Join(c.release, ",") {
+				t.Fatalf("planBlocks() release = %v, want %v", released, c.release)
+			}
+			if strings.Join(claim, ",") != strings.Join(c.claim, ",") {
+				t.Fatalf("planBlocks() claim = %v, want %v", claim, c.claim)
+			}
+		})
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/containernetworking/cni/pkg/version"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"test-cni/ipam"
+	"test-cni/nettools"
+	"test-cni/utils"
+	"time"
+)
+
+// defaultCNIVersion 和旧版本生成的配置保持一致，1.1.0需要运行时使用libcni 1.2及以上，要通过TESTCNI_CNI_VERSION显式开启
+const defaultCNIVersion = "0.4.0"
+
+// ipam模式：node使用kube-controller-manager分给节点的PodCIDR，cluster把ClusterCidrs切成地址块按需分给节点
+const (
+	ipamModeNode    = "node"
+	ipamModeCluster = "cluster"
+)
+
+// dsConfig daemonset的配置，通过deploy.yaml中的环境变量传入
+type dsConfig struct {
+	//整个集群的pod网段，访问这些网段不做snat，不填时只豁免本节点的pod网段
+	//cluster模式下从这里切出地址块，每个地址族一个
+	ClusterCidrs []string
+	//额外不需要snat的目的网段，比如机房内网
+	NonMasqueradeCidrs []string
+	//节点ip会变化（比如dhcp）时使用MASQUERADE
+	Masquerade bool
+	//不分配给pod的网段，比如放在pod网段里的vip，只有落在本节点pod网段内的才会写进cni配置
+	IpamExclude []string
+	//命名的ip池，每个节点使用自己的网段
+	Pools []*poolConf
+	//插件是否读取pod上的固定ip、ip池注解，读取时每次ADD都要访问apiserver，默认关闭
+	PodAnnotations bool
+	//mtu、网桥名、vxlan设备等配置，会写进cni配置文件给插件使用
+	nettools.DeviceConfig
+	//没有配置TESTCNI_MTU时根据InternalIP所在网卡的mtu自动计算
+	AutoMTU bool
+	//ip回收的间隔和宽限期，预留时间不到宽限期的ip不会被回收
+	GCInterval    time.Duration
+	GCGracePeriod time.Duration
+	//ip释放之后多久才能被再次自动分配，为0时不限制
+	IpQuarantine time.Duration
+	//写入cni配置的cniVersion，1.1.0起运行时才会调用GC和STATUS，默认0.4.0
+	CNIVersion string
+	//ipam模式，默认node
+	IpamMode string
+	//cluster模式下ipv4、ipv6地址块的掩码长度
+	BlockSize   int
+	BlockSizeV6 int
+}
+
+func loadConfig() (*dsConfig, error) {
+	c := &dsConfig{
+		ClusterCidrs:       splitEnv("TESTCNI_CLUSTER_CIDRS"),
+		NonMasqueradeCidrs: splitEnv("TESTCNI_NON_MASQUERADE_CIDRS"),
+		Masquerade:         os.Getenv("TESTCNI_MASQUERADE") == "true",
+		PodAnnotations:     os.Getenv("TESTCNI_POD_ANNOTATIONS") == "true",
+		IpamExclude:        splitEnv("TESTCNI_IPAM_EXCLUDE"),
+		CNIVersion:         strings.TrimSpace(os.Getenv("TESTCNI_CNI_VERSION")),
+		IpamMode:           strings.TrimSpace(os.Getenv("TESTCNI_IPAM_MODE")),
+	}
+	if c.CNIVersion == "" {
+		c.CNIVersion = defaultCNIVersion
+	}
+	if !utils.StringsIn(version.All.SupportedVersions(), c.CNIVersion) {
+		return nil, fmt.Errorf("env TESTCNI_CNI_VERSION=%s should be one of %v", c.CNIVersion, version.All.SupportedVersions())
+	}
+	if c.IpamMode == "" {
+		c.IpamMode = ipamModeNode
+	}
+	c.Bridge = os.Getenv("TESTCNI_BRIDGE")
+	c.VxlanDevice = os.Getenv("TESTCNI_VXLAN_DEVICE")
+	var err error
+	if c.MTU, err = intEnv("TESTCNI_MTU"); err != nil {
+		return nil, err
+	}
+	//没有配置时留空使用默认值，显式配置的0由Validate报错
+	if strings.TrimSpace(os.Getenv("TESTCNI_VNI")) != "" {
+		vni, err := intEnv("TESTCNI_VNI")
+		if err != nil {
+			return nil, err
+		}
+		c.VNI = &vni
+	}
+	if c.VxlanPort, err = intEnv("TESTCNI_VXLAN_PORT"); err != nil {
+		return nil, err
+	}
+	if c.VxlanSrcPort, err = nettools.ParsePortRange(os.Getenv("TESTCNI_VXLAN_SRC_PORT")); err != nil {
+		return nil, err
+	}
+	if c.GCInterval, err = durationEnv("TESTCNI_IPAM_GC_INTERVAL", 5*time.Minute); err != nil {
+		return nil, err
+	}
+	if c.GCGracePeriod, err = durationEnv("TESTCNI_IPAM_GC_GRACE_PERIOD", 10*time.Minute); err != nil {
+		return nil, err
+	}
+	if c.IpQuarantine, err = durationEnv("TESTCNI_IPAM_QUARANTINE", 0); err != nil {
+		return nil, err
+	}
+	if c.BlockSize, err = intEnv("TESTCNI_IPAM_BLOCK_SIZE"); err != nil {
+		return nil, err
+	}
+	if c.BlockSizeV6, err = intEnv("TESTCNI_IPAM_BLOCK_SIZE_V6"); err != nil {
+		return nil, err
+	}
+	if err = c.validateIpamMode(); err != nil {
+		return nil, err
+	}
+	if v := strings.TrimSpace(os.Getenv("TESTCNI_POOLS")); v != "" {
+		if err = json.Unmarshal([]byte(v), &c.Pools); err != nil {
+			return nil, fmt.Errorf("env TESTCNI_POOLS is not valid json:%s", err.Error())
+		}
+	}
+	if err = c.validatePools(); err != nil {
+		return nil, err
+	}
+	for _, cidr := range c.IpamExclude {
+		if _, _, err = net.ParseCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("env TESTCNI_IPAM_EXCLUDE has invalid cidr %s", cidr)
+		}
+	}
+	c.AutoMTU = c.MTU == 0
+	c.SetDefaults()
+	if err = c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// validateIpamMode cluster模式下每个地址族一个集群网段，地址块要比集群网段小，至少留几个ip给pod
+func (c *dsConfig) validateIpamMode() error {
+	switch c.IpamMode {
+	case ipamModeNode:
+		return nil
+	case ipamModeCluster:
+	default:
+		return fmt.Errorf("env TESTCNI_IPAM_MODE=%s should be %s or %s", c.IpamMode, ipamModeNode, ipamModeCluster)
+	}
+	if c.BlockSize == 0 {
+		c.BlockSize = 26
+	}
+	if c.BlockSizeV6 == 0 {
+		c.BlockSizeV6 = 122
+	}
+	if c.BlockSize < 16 || c.BlockSize > 29 {
+		return fmt.Errorf("env TESTCNI_IPAM_BLOCK_SIZE=%d out of range [16, 29]", c.BlockSize)
+	}
+	if c.BlockSizeV6 < 96 || c.BlockSizeV6 > 125 {
+		return fmt.Errorf("env TESTCNI_IPAM_BLOCK_SIZE_V6=%d out of range [96, 125]", c.BlockSizeV6)
+	}
+	if len(c.ClusterCidrs) == 0 {
+		return fmt.Errorf("env TESTCNI_CLUSTER_CIDRS is required in %s ipam mode", ipamModeCluster)
+	}
+	families := make(map[bool]string)
+	for _, cidr := range c.ClusterCidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("env TESTCNI_CLUSTER_CIDRS has invalid cidr %s", cidr)
+		}
+		isV6 := ipNet.IP.To4() == nil
+		if other, ok := families[isV6]; ok {
+			return fmt.Errorf("cluster cidr %s and %s are in the same ip family", other, cidr)
+		}
+		families[isV6] = cidr
+		if ones, _ := ipNet.Mask.Size(); ones > c.blockSize(isV6) {
+			return fmt.Errorf("cluster cidr %s is smaller than a /%d block", cidr, c.blockSize(isV6))
+		}
+	}
+	return nil
+}
+
+// validatePools 和插件的检查一致，配置错误时daemonset起不来，而不是每次ADD都失败
+// 池的名字不能重复，一个命名空间只能属于一个池，每个节点上每个地址族最多一个网段，
+// 所有节点上池的网段互不重叠，cluster模式下也不能和集群网段重叠，和节点pod网段的重叠在拿到PodCIDR之后检查
+func (c *dsConfig) validatePools() error {
+	names := make(map[string]bool)
+	namespaces := make(map[string]string)
+	var subnets []string
+	if c.IpamMode == ipamModeCluster {
+		subnets = append(subnets, c.ClusterCidrs...)
+	}
+	for _, p := range c.Pools {
+		if p.Name == "" {
+			return fmt.Errorf("env TESTCNI_POOLS has a pool without name")
+		}
+		if names[p.Name] {
+			return fmt.Errorf("duplicate pool name:%s", p.Name)
+		}
+		names[p.Name] = true
+		for _, ns := range p.Namespaces {
+			if other, ok := namespaces[ns]; ok {
+				return fmt.Errorf("namespace %s is in both pool %s and %s", ns, other, p.Name)
+			}
+			namespaces[ns] = p.Name
+		}
+		var nodes []string
+		for node := range p.Nodes {
+			nodes = append(nodes, node)
+		}
+		sort.Strings(nodes)
+		for _, node := range nodes {
+			families := make(map[bool]string)
+			for _, r := range p.Nodes[node] {
+				if err := r.Validate(); err != nil {
+					return fmt.Errorf("pool %s of node %s: %s", p.Name, node, err.Error())
+				}
+				isV6 := ipam.IsIPv6Cidr(r.Subnet)
+				if other, ok := families[isV6]; ok {
+					return fmt.Errorf("pool %s of node %s: subnet %s and %s are in the same ip family", p.Name, node, other, r.Subnet)
+				}
+				families[isV6] = r.Subnet
+				subnets = append(subnets, r.Subnet)
+			}
+		}
+	}
+	return ipam.CheckOverlap(subnets)
+}
+
+func (c *dsConfig) blockSize(isV6 bool) int {
+	if isV6 {
+		return c.BlockSizeV6
+	}
+	return c.BlockSize
+}
+
+func durationEnv(name string, def time.Duration) (time.Duration, error) {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("env %s=%s is not a valid duration", name, v)
+	}
+	return d, nil
+}
+
+func intEnv(name string) (int, error) {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("env %s=%s is not a number", name, v)
+	}
+	return i, nil
+}
+
+func splitEnv(name string) []string {
+	var res []string
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// cniConf 写入/etc/cni/net.d的插件配置
+type cniConf struct {
+	CNIVersion   string          `json:"cniVersion"`
+	Name         string          `json:"name"`
+	Type         string          `json:"type"`
+	Capabilities map[string]bool `json:"capabilities,omitempty"`
+	Ranges       []*ipam.Range   `json:"ranges,omitempty"`
+	Blocks       []string        `json:"blocks,omitempty"`
+	Exclude      []string        `json:"exclude,omitempty"`
+	Pools        []*cniPool      `json:"pools,omitempty"`
+	Kubeconfig   string          `json:"kubeconfig,omitempty"`
+	IpQuarantine int             `json:"ipQuarantine,omitempty"`
+	nettools.DeviceConfig
+}
+
+// nodeRanges 本节点pod网段写进cni配置的范围，网桥上的网关也按这些范围计算，和插件使用的网关保持一致
+func nodeRanges(podCidrs, exclude []string) []*ipam.Range {
+	var res []*ipam.Range
+	for _, cidr := range podCidrs {
+		res = append(res, &ipam.Range{Subnet: cidr, Exclude: nodeExclude([]string{cidr}, exclude)})
+	}
+	return res
+}
+
+// nodeExclude 返回和本节点pod网段（或地址块）相关的排除网段，其他节点的网段和本节点无关
+// 落在网段内的原样保留，比网段大、把整个网段包含进去的裁成网段本身，插件只接受子网内的排除网段
+func nodeExclude(podCidrs, exclude []string) []string {
+	var res []string
+	add := func(cidr string) {
+		if !utils.StringsIn(res, cidr) {
+			res = append(res, cidr)
+		}
+	}
+	for _, cidr := range exclude {
+		_, excludeNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		excludeOnes, excludeBits := excludeNet.Mask.Size()
+		for _, podCidr := range podCidrs {
+			_, podNet, err := net.ParseCIDR(podCidr)
+			if err != nil {
+				continue
+			}
+			podOnes, podBits := podNet.Mask.Size()
+			if podBits != excludeBits {
+				continue
+			}
+			if excludeOnes >= podOnes && podNet.Contains(excludeNet.IP) {
+				add(cidr)
+			} else if excludeOnes < podOnes && excludeNet.Contains(podNet.IP) {
+				add(podNet.String())
+			}
+		}
+	}
+	return res
+}
+
+// poolConf TESTCNI_POOLS中的一个ip池，Nodes的key是节点名，value是这个节点上该池的网段
+type poolConf struct {
+	Name       string                   `json:"name"`
+	Namespaces []string                 `json:"namespaces"`
+	Nodes      map[string][]*ipam.Range `json:"nodes"`
+}
+
+// cniPool 写进cni配置的ip池，只包含本节点的网段
+type cniPool struct {
+	Name       string        `json:"name"`
+	Namespaces []string      `json:"namespaces"`
+	Ranges     []*ipam.Range `json:"ranges"`
+}
+
+// nodePools 返回节点上的ip池，没有为这个节点配置网段的池也要写进去（ranges为空），
+// 插件据此拒绝这个池的pod，而不是让它们拿到节点pod网段的ip
+func (c *dsConfig) nodePools(nodeName string) []*cniPool {
+	var res []*cniPool
+	for _, p := range c.Pools {
+		res = append(res, &cniPool{Name: p.Name, Namespaces: p.Namespaces, Ranges: p.Nodes[nodeName]})
+	}
+	return res
+}
+
+// allPoolSubnets 返回所有节点上所有ip池的网段，访问这些网段不做snat
+func (c *dsConfig) allPoolSubnets() []string {
+	var res []string
+	for _, p := range c.Pools {
+		for _, ranges := range p.Nodes {
+			for _, r := range ranges {
+				res = append(res, r.Subnet)
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/vishvananda/netlink"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"net"
+	"strings"
+	"test-cni/ipam"
+	"test-cni/nettools"
+)
+
+// poolCidrsAnnotation 节点上ip池的网段，逗号分隔
+const poolCidrsAnnotation = "testcni_pool_cidrs"
+
+// blockCidrsAnnotation cluster ipam模式下节点的地址块，逗号分隔，其他节点为每个地址块加一条路由
+const blockCidrsAnnotation = "testcni_block_cidrs"
+
+// deviceReconciler 保证网桥和vxlan设备符合期望，节点重启或者被手动改过之后自动修复
+type deviceReconciler struct {
+	bridge     string
+	gws        []*net.IPNet
+	mtu        int
+	vxlanOpts  *nettools.VxlanOptions
+	vxlanIps   []*net.IPNet
+	internalIp string
+	//本节点ip池的网段，写到注解上让其他节点加路由
+	poolCidrs []string
+	//cluster ipam模式下本节点的地址块，网关随地址块加到网桥上
+	blockCidrs []string
+}
+
+func (r *deviceReconciler) reconcile() (*netlink.Vxlan, error) {
+	gws := append([]*net.IPNet{}, r.gws...)
+	//地址块不能配置网关，和插件一样按Range计算
+	for _, cidr := range r.blockCidrs {
+		gws = append(gws, (&ipam.Range{Subnet: cidr}).GetGateway())
+	}
+	_, changes, err := nettools.EnsureBridge(r.bridge, gws, r.mtu)
+	printChanges(changes)
+	if err != nil {
+		return nil, fmt.Errorf("EnsureBridge error:%s", err.Error())
+	}
+
+	vxlan, changes, err := nettools.EnsureVxlan(r.vxlanOpts, r.vxlanIps...)
+	printChanges(changes)
+	if err != nil {
+		return nil, fmt.Errorf("EnsureVxlan error:%s", err.Error())
+	}
+	return vxlan, nil
+}
+
+// annotateNode 把vxlan设备的ip、mac和宿主机ip写到节点注解上，其他节点据此写fdb、arp和路由
+func (r *deviceReconciler) annotateNode(clientSet kubernetes.Interface, nodeName string, vxlan *netlink.Vxlan) error {
+	node, err := clientSet.CoreV1().Nodes().Get(context.TODO(), nodeName, v1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	//双栈时每个地址族一组ip|mac，用逗号分隔
+	var ipToMacs []string
+	for _, vxlanIp := range r.vxlanIps {
+		ipToMacs = append(ipToMacs, fmt.Sprintf("%s|%s", vxlanIp.IP.String(), vxlan.HardwareAddr))
+	}
+	if node.Annotations == nil {
+		node.Annotations = make(map[string]string)
+	}
+	node.Annotations["vxlan_ip_to_vxlan_mac"] = strings.Join(ipToMacs, ",")
+	node.Annotations["vxlan_mac_to_host_ip"] = fmt.Sprintf("%s|%s", vxlan.HardwareAddr, r.internalIp)
+	if len(r.poolCidrs) > 0 {
+		node.Annotations[poolCidrsAnnotation] = strings.Join(r.poolCidrs, ",")
+	} else {
+		delete(node.Annotations, poolCidrsAnnotation)
+	}
+	if len(r.blockCidrs) > 0 {
+		node.Annotations[blockCidrsAnnotation] = strings.Join(r.blockCidrs, ",")
+	} else {
+		delete(node.Annotations, blockCidrsAnnotation)
+	}
+	_, err = clientSet.CoreV1().Nodes().Update(context.TODO(), node, v1.UpdateOptions{})
+	return err
+}
+
+func printChanges(changes []string) {
+	for _, c := range changes {
+		fmt.Println("reconcile:", c)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"test-cni/ipam"
+	"test-cni/utils"
+	"time"
+)
+
+// ipGC 定期回收漏掉DEL的ip：预留记录里的ip不属于本节点任何一个pod，并且超过了宽限期
+type ipGC struct {
+	clientSet kubernetes.Interface
+	nodeName  string
+	//只回收这个网络的记录，testcni-ipam给macvlan等其他网络分配的ip不在pod状态里
+	network     string
+	gracePeriod time.Duration
+	lockTimeout time.Duration
+	//累计回收的ip个数
+	reclaimed int
+}
+
+func (g *ipGC) run() {
+	pods, err := g.clientSet.CoreV1().Pods("").List(context.TODO(), v1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", g.nodeName).String(),
+	})
+	if err != nil {
+		fmt.Println("gc: list pods error:", err.Error())
+		return
+	}
+	liveIps := make(map[string]bool)
+	for _, p := range pods.Items {
+		if p.Spec.HostNetwork || p.Status.Phase == corev1.PodSucceeded || p.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		for _, ip := range p.Status.PodIPs {
+			liveIps[ip.IP] = true
+		}
+	}
+
+	lock, err := utils.AcquireLock(g.lockTimeout)
+	if err != nil {
+		fmt.Println("gc: AcquireLock error:", err.Error())
+		return
+	}
+	defer lock.Release()
+	if err = ipam.Migrate(); err != nil {
+		fmt.Println("gc: migrate ipam store error:", err.Error())
+		return
+	}
+
+	reservations, err := ipam.ListReservations()
+	if err != nil {
+		fmt.Println("gc: list reservations error:", err.Error())
+		return
+	}
+	for _, r := range reservations {
+		if r.Network != "" && r.Network != g.network {
+			continue
+		}
+		//刚分配的ip还没来得及出现在pod状态里
+		if time.Since(r.CreatedAt) < g.gracePeriod {
+			continue
+		}
+		var live bool
+		for _, ip := range r.Ips {
+			if liveIps[ip] {
+				live = true
+				break
+			}
+		}
+		if live {
+			continue
+		}
+		if err = ipam.ReleaseReservation(r); err != nil {
+			fmt.Println(fmt.Sprintf("gc: release %v of container %s/%s error:%s", r.Ips, r.ContainerId, r.IfName, err.Error()))
+			continue
+		}
+		g.reclaimed += len(r.Ips)
+		fmt.Println(fmt.Sprintf("gc: reclaimed %v of container %s/%s created at %s, total reclaimed %d",
+			r.Ips, r.ContainerId, r.IfName, r.CreatedAt.Format(time.RFC3339), g.reclaimed))
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"os"
+	"test-cni/utils"
+)
+
+// pluginKubeconfigPath 插件读取pod注解用的kubeconfig，和cni配置放在一起
+const pluginKubeconfigPath = "/etc/cni/net.d/testcni-kubeconfig"
+
+// writePluginKubeconfig 用daemonset自己的serviceaccount生成插件的kubeconfig
+// serviceaccount的token会轮换，内容没变时不重写
+func writePluginKubeconfig(config *rest.Config) error {
+	token := config.BearerToken
+	if config.BearerTokenFile != "" {
+		b, err := os.ReadFile(config.BearerTokenFile)
+		if err != nil {
+			return fmt.Errorf("read token file error:%s", err.Error())
+		}
+		token = string(b)
+	}
+	caData := config.TLSClientConfig.CAData
+	if len(caData) == 0 && config.TLSClientConfig.CAFile != "" {
+		b, err := os.ReadFile(config.TLSClientConfig.CAFile)
+		if err != nil {
+			return fmt.Errorf("read ca file error:%s", err.Error())
+		}
+		caData = b
+	}
+
+	kubeconfig := clientcmdapi.NewConfig()
+	kubeconfig.Clusters["local"] = &clientcmdapi.Cluster{
+		Server:                   config.Host,
+		CertificateAuthorityData: caData,
+	}
+	kubeconfig.AuthInfos["test-cni"] = &clientcmdapi.AuthInfo{Token: token}
+	kubeconfig.Contexts["test-cni"] = &clientcmdapi.Context{Cluster: "local", AuthInfo: "test-cni"}
+	kubeconfig.CurrentContext = "test-cni"
+	content, err := clientcmd.Write(*kubeconfig)
+	if err != nil {
+		return fmt.Errorf("marshal kubeconfig error:%s", err.Error())
+	}
+
+	if old, err := os.ReadFile(pluginKubeconfigPath); err == nil && bytes.Equal(old, content) {
+		return nil
+	}
+	return utils.WriteFileAtomic(pluginKubeconfigPath, content, 0600)
+}
+
+// removePluginKubeconfig 关闭注解之后节点上不再留着serviceaccount的token
+func removePluginKubeconfig() error {
+	if err := os.Remove(pluginKubeconfigPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
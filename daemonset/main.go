@@ -2,19 +2,33 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/vishvananda/netlink"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
-	"strings"
+	"net"
+	"reflect"
 	"test-cni/ipam"
 	"test-cni/nettools"
 	"test-cni/utils"
 	"time"
 )
 
+// networkName 写入cni配置的网络名，ipam记录按它区分
+const networkName = "test-cni"
+
+const peerResyncPeriod = 30 * time.Second
+
+// gcLockTimeout gc和插件共用ipam锁，拿不到锁就等下一轮，不阻塞插件
+const gcLockTimeout = 10 * time.Second
+
 func main() {
 	defer func() {
 		select {}
@@ -24,6 +38,17 @@ func main() {
 		fmt.Println("copy file error:", err.Error())
 		return
 	}
+	//独立的ipam插件，给macvlan等其他网络分配ip，和test-cni共用ip存储
+	err = utils.CopyFile("/root/testcni-ipam", "/opt/cni/bin/")
+	if err != nil {
+		fmt.Println("copy file error:", err.Error())
+		return
+	}
+	dsConf, err := loadConfig()
+	if err != nil {
+		fmt.Println("load config error:", err.Error())
+		return
+	}
 	config, err := clientcmd.BuildConfigFromFlags("", "")
 	if err != nil {
 		fmt.Println(err.Error())
@@ -64,7 +89,23 @@ func main() {
 		fmt.Println("currentNode is nil")
 		return
 	}
-	if currentNode.Spec.PodCIDR == "" {
+	//cluster ipam模式下不使用PodCIDR，每个地址族的主地址块承担原来pod网段的角色，其余地址块按需增减
+	var bm *blockManager
+	var podCidrs, blocks []string
+	if dsConf.IpamMode == ipamModeCluster {
+		if bm, err = newBlockManager(clientSet, currentNode.Name, dsConf); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		if podCidrs, blocks, err = bm.start(); err != nil {
+			fmt.Println("assign blocks error:", err.Error())
+			return
+		}
+		fmt.Println(fmt.Sprintf("ipam blocks of %s: %v", currentNode.Name, blocks))
+	} else {
+		podCidrs = getPodCidrs(currentNode)
+	}
+	if len(podCidrs) == 0 {
 		fmt.Println("pod cidr is empty!")
 		return
 	}
@@ -74,115 +115,278 @@ func main() {
 		fmt.Println("can not found the internalIp interface")
 		return
 	}
-	//创建bridge设备
-	currentGw := ipam.GetGateway(currentNode.Spec.PodCIDR)
-	if currentGw == nil {
-		fmt.Println("currentGw can not be nil")
-		return
-	}
-	_, err = nettools.CreateBridge("testcni0", currentGw, 1450)
+	underlayLink, err := netlink.LinkByName(currentInternalIpInterface)
 	if err != nil {
-		fmt.Println("CreateBridge error:", err.Error())
+		fmt.Println("get internalIp interface error:", err.Error())
 		return
 	}
+	//减去vxlan封装的开销，巨型帧或者底层已经有封装的网络上1450都不对
+	if dsConf.AutoMTU {
+		underlayMTU := underlayLink.Attrs().MTU
+		dsConf.MTU = nettools.OverlayMTU(underlayMTU, net.ParseIP(currentInternalIp))
+		if err = dsConf.Validate(); err != nil {
+			fmt.Println("detected mtu invalid:", err.Error())
+			return
+		}
+		fmt.Println(fmt.Sprintf("detected mtu %d from %s(mtu %d)", dsConf.MTU, currentInternalIpInterface, underlayMTU))
+	}
 
-	//创建vxlan设备
-	vxlanIp := ipam.GetVxlanIp(currentNode.Spec.PodCIDR)
-	if vxlanIp == nil {
-		fmt.Println("vxlanIp can not be empty")
+	//网桥上每个地址族一个网关，每个ip池再各加一个，vxlan设备上每个地址族一个ip
+	pools := dsConf.nodePools(currentNode.Name)
+	var currentGws, vxlanIps []*net.IPNet
+	var poolCidrs []string
+	for _, p := range pools {
+		for _, r := range p.Ranges {
+			currentGws = append(currentGws, r.GetGateway())
+			poolCidrs = append(poolCidrs, r.Subnet)
+		}
+	}
+	//ip池的网段不能和节点的pod网段重叠，否则插件校验配置失败，每次ADD都会报错
+	if err = ipam.CheckOverlap(append(append([]string{}, podCidrs...), dsConf.allPoolSubnets()...)); err != nil {
+		fmt.Println("invalid env TESTCNI_POOLS:", err.Error())
 		return
 	}
-	vxlan, err := nettools.CreateVxlanAndUp("testcni.1", 1500, vxlanIp)
+	ranges := nodeRanges(podCidrs, dsConf.IpamExclude)
+	for _, r := range ranges {
+		currentGw := r.GetGateway()
+		if currentGw == nil {
+			fmt.Println("currentGw can not be nil")
+			return
+		}
+		//地址块的网关由deviceReconciler根据blockCidrs添加
+		if bm == nil {
+			currentGws = append(currentGws, currentGw)
+		}
+		vxlanIp := ipam.GetVxlanIp(r.Subnet)
+		if vxlanIp == nil {
+			fmt.Println("vxlanIp can not be empty")
+			return
+		}
+		vxlanIps = append(vxlanIps, vxlanIp)
+	}
+
+	//创建或修复bridge和vxlan设备
+	dr := &deviceReconciler{
+		bridge: dsConf.Bridge,
+		gws:    currentGws,
+		mtu:    dsConf.MTU,
+		vxlanOpts: &nettools.VxlanOptions{
+			Name:     dsConf.VxlanDevice,
+			MTU:      dsConf.MTU,
+			VNI:      dsConf.GetVNI(),
+			Port:     dsConf.VxlanPort,
+			PortLow:  dsConf.VxlanSrcPort.Low,
+			PortHigh: dsConf.VxlanSrcPort.High,
+			//绑定到InternalIP所在的网卡和地址上，避免多网卡节点从错误的地址发出封装报文
+			VtepDevIndex: underlayLink.Attrs().Index,
+			SrcAddr:      net.ParseIP(currentInternalIp),
+		},
+		vxlanIps:   vxlanIps,
+		internalIp: currentInternalIp,
+		poolCidrs:  poolCidrs,
+		blockCidrs: blocks,
+	}
+	vxlan, err := dr.reconcile()
 	if err != nil {
-		fmt.Println("CreateVxlanAndUp error:", err.Error())
+		fmt.Println(err.Error())
 		return
 	}
 
 	//更新currentNode
-	currentNode.Annotations["vxlan_ip_to_vxlan_mac"] = fmt.Sprintf("%s|%s", vxlanIp.IP.String(), vxlan.HardwareAddr)
-	currentNode.Annotations["vxlan_mac_to_host_ip"] = fmt.Sprintf("%s|%s", vxlan.HardwareAddr, currentInternalIp)
-	_, err = clientSet.CoreV1().Nodes().Update(context.TODO(), currentNode, v1.UpdateOptions{})
+	err = dr.annotateNode(clientSet, currentNode.Name, vxlan)
 	if err != nil {
 		fmt.Println("update node info error:", err.Error())
 		return
 	}
 
+	//开启注解时插件通过这个kubeconfig读取pod上的固定ip和ip池注解
+	//不开启时删掉之前写的kubeconfig，插件不访问apiserver，apiserver不可用也不影响ADD
+	var kubeconfig string
+	if dsConf.PodAnnotations {
+		if err = writePluginKubeconfig(config); err != nil {
+			fmt.Println("write plugin kubeconfig error:", err.Error())
+			return
+		}
+		kubeconfig = pluginKubeconfigPath
+	} else if err = removePluginKubeconfig(); err != nil {
+		fmt.Println("remove plugin kubeconfig error:", err.Error())
+		return
+	}
+
 	//将网络插件配置写入相应文件
-	cniConfig := fmt.Sprintf(`{
-        "cniVersion": "0.4.0",
-        "name": "test-cni",
-        "type": "test-cni",
-        "subnet": "%s"
-}`, currentNode.Spec.PodCIDR)
-	err = utils.CreateFile("/etc/cni/net.d/10-testcni.conf", []byte(cniConfig), 0766)
+	cniConfig := &cniConf{
+		CNIVersion: dsConf.CNIVersion,
+		Name:       networkName,
+		Type:       "test-cni",
+		//允许运行时通过runtimeConfig.ips请求固定ip
+		Capabilities: map[string]bool{"ips": true},
+		Ranges:       ranges,
+		Pools:        pools,
+		Kubeconfig:   kubeconfig,
+		IpQuarantine: int(dsConf.IpQuarantine / time.Second),
+		DeviceConfig: dsConf.DeviceConfig,
+	}
+	//cluster ipam模式下插件从地址块中分配，地址块变化时重写配置
+	//先更新本节点的地址块列表再写配置，插件在锁内按这个列表过滤，新加的块不会因为列表还没更新被跳过
+	var writtenBlocks []string
+	writeBlocks := func(blocks []string) error {
+		if err := ipam.SetNodeBlocks(blocks); err != nil {
+			return fmt.Errorf("write node blocks error:%s", err.Error())
+		}
+		cniConfig.Ranges = nil
+		cniConfig.Blocks = blocks
+		cniConfig.Exclude = nodeExclude(blocks, dsConf.IpamExclude)
+		if err := writeCniConfig(cniConfig); err != nil {
+			return err
+		}
+		writtenBlocks = blocks
+		return nil
+	}
+	if bm != nil {
+		err = writeBlocks(blocks)
+	} else {
+		err = writeCniConfig(cniConfig)
+	}
 	if err != nil {
-		fmt.Println("CreateCniConfig error:", err.Error())
+		fmt.Println(err.Error())
 		return
 	}
 
-	//添加snat
-	err = nettools.AddSNat(currentNode.Spec.PodCIDR, currentInternalIp, currentInternalIpInterface)
+	//清理旧版本直接加在POSTROUTING上的snat规则，然后重建TESTCNI-POSTROUTING链
+	for _, cidr := range podCidrs {
+		err = nettools.DelSNat(cidr, currentInternalIp, currentInternalIpInterface)
+		if err != nil {
+			fmt.Println("delete legacy snat error:", err.Error())
+			return
+		}
+	}
+	clusterCidrs := append([]string{}, dsConf.ClusterCidrs...)
+	if len(clusterCidrs) == 0 {
+		clusterCidrs = append(clusterCidrs, podCidrs...)
+	}
+	//ip池的网段不一定在集群网段内，所有节点的池之间互访也不做snat
+	clusterCidrs = append(clusterCidrs, dsConf.allPoolSubnets()...)
+	//地址块会变化，cluster ipam模式下按整个集群网段匹配本节点pod发出的流量
+	srcCidrs := append([]string{}, podCidrs...)
+	if bm != nil {
+		srcCidrs = append([]string{}, dsConf.ClusterCidrs...)
+	}
+	err = nettools.SyncMasquerade(&nettools.MasqConfig{
+		PodCidrs:           append(srcCidrs, poolCidrs...),
+		ClusterCidrs:       clusterCidrs,
+		NonMasqueradeCidrs: dsConf.NonMasqueradeCidrs,
+		HostIp:             currentInternalIp,
+		Dev:                currentInternalIpInterface,
+		Masquerade:         dsConf.Masquerade,
+	})
 	if err != nil {
-		fmt.Println("add snat error:", err.Error())
+		fmt.Println("sync masquerade error:", err.Error())
 		return
 	}
-	time.Sleep(5 * time.Second)
 
-	var otherNodes []corev1.Node
-	nodes, err = clientSet.CoreV1().Nodes().List(context.TODO(), v1.ListOptions{})
+	//监听Node的增删改，动态维护到其他节点的fdb、arp和路由，定期resync修复被手动删掉的表项
+	pm := newPeerManager(vxlan, currentNode.Name)
+	factory := informers.NewSharedInformerFactory(clientSet, peerResyncPeriod)
+	nodeInformer := factory.Core().V1().Nodes().Informer()
+	_, err = nodeInformer.AddEventHandler(pm.handlers())
 	if err != nil {
-		fmt.Println(err)
+		fmt.Println("add node event handler error:", err.Error())
 		return
 	}
-	for _, n := range nodes.Items {
-		if n.Name != currentNode.Name {
-			otherNodes = append(otherNodes, n)
-		}
+	stopCh := make(chan struct{})
+	factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, nodeInformer.HasSynced) {
+		fmt.Println("wait for node cache sync failed")
+		return
 	}
 
-	//写入fdb、arp、路由表
-	for _, n := range otherNodes {
-		ipToMac := n.Annotations["vxlan_ip_to_vxlan_mac"]
-		ipToMacArr := strings.Split(ipToMac, "|")
-		if len(ipToMacArr) != 2 {
-			fmt.Println(fmt.Sprintf("vxlan_ip_to_vxlan_mac:%s incorrect", ipToMac))
-			return
+	//informer还没看到的节点再向apiserver确认一次，避免释放刚加入的节点的地址块
+	nodeLister := factory.Core().V1().Nodes().Lister()
+	nodeExists := func(name string) bool {
+		if _, err := nodeLister.Get(name); err == nil {
+			return true
 		}
+		_, err := clientSet.CoreV1().Nodes().Get(context.TODO(), name, v1.GetOptions{})
+		return !errors.IsNotFound(err)
+	}
 
-		macToIp := n.Annotations["vxlan_mac_to_host_ip"]
-		macToIpArr := strings.Split(macToIp, "|")
-		if len(macToIpArr) != 2 {
-			fmt.Println(fmt.Sprintf("vxlan_mac_to_host_ip:%s incorrect", macToIp))
-			return
+	//定期修复网桥和vxlan设备，vxlan被重建后mac会变，需要重新写注解并重写到其他节点的表项
+	//cluster ipam模式下同时按使用情况增减地址块，地址块变化后更新网桥上的网关和节点注解
+	go wait.Until(func() {
+		//token轮换之后更新插件的kubeconfig
+		if dsConf.PodAnnotations {
+			if err := writePluginKubeconfig(config); err != nil {
+				fmt.Println("write plugin kubeconfig error:", err.Error())
+			}
 		}
-
-		err = nettools.CreateFdbEntry(macToIpArr[0], macToIpArr[1], vxlan.Name)
-		if err != nil {
-			fmt.Println("CreateFdbEntry error:", err.Error())
-			return
+		var blocksChanged bool
+		if bm != nil {
+			newBlocks, err := bm.sync(nodeExists, writeBlocks)
+			if err != nil {
+				fmt.Println("sync blocks error:", err.Error())
+			} else {
+				//释放时分配表没有更新成功，配置里会少掉仍然属于本节点的块，和分配表不一致就重写
+				if !reflect.DeepEqual(newBlocks, writtenBlocks) {
+					if err = writeBlocks(newBlocks); err != nil {
+						fmt.Println(err.Error())
+					}
+				}
+				if !reflect.DeepEqual(newBlocks, dr.blockCidrs) {
+					fmt.Println(fmt.Sprintf("ipam blocks of %s: %v", currentNode.Name, newBlocks))
+					dr.blockCidrs = newBlocks
+					blocksChanged = true
+				}
+			}
 		}
-
-		err = nettools.CreateArpEntry(ipToMacArr[0], ipToMacArr[1], vxlan.Name)
+		newVxlan, err := dr.reconcile()
 		if err != nil {
-			fmt.Println("CreateArpEntry error:", err.Error())
+			fmt.Println(err.Error())
 			return
 		}
-
-		otherGw := ipam.GetVxlanIp(n.Spec.PodCIDR)
-		if otherGw == nil {
-			fmt.Println("otherGw can not be nil")
+		if !blocksChanged && newVxlan.Attrs().Index == vxlan.Attrs().Index && newVxlan.HardwareAddr.String() == vxlan.HardwareAddr.String() {
 			return
 		}
-		ipNet := ipam.CidrToIpNet(n.Spec.PodCIDR)
-		if ipNet == nil {
-			fmt.Println("ipNet can not be nil")
-			return
-		}
-		err = nettools.AddRoute(ipNet, otherGw.IP, vxlan, int(netlink.FLAG_ONLINK))
-		if err != nil {
-			fmt.Println(fmt.Sprintf("AddRoute second %s,%s error:%s", ipNet, otherGw.IP, err.Error()))
+		if err = dr.annotateNode(clientSet, currentNode.Name, newVxlan); err != nil {
+			fmt.Println("update node info error:", err.Error())
 			return
 		}
+		vxlan = newVxlan
+		pm.setVxlan(newVxlan)
+	}, peerResyncPeriod, stopCh)
+
+	//回收漏掉DEL的ip
+	gc := &ipGC{
+		clientSet:   clientSet,
+		nodeName:    currentNode.Name,
+		network:     networkName,
+		gracePeriod: dsConf.GCGracePeriod,
+		lockTimeout: gcLockTimeout,
 	}
+	go wait.Until(gc.run, dsConf.GCInterval, stopCh)
 	fmt.Println("plugin init ok!")
 }
+
+// writeCniConfig 把插件配置写到/etc/cni/net.d，运行时每次调用插件都会重新读取
+func writeCniConfig(conf *cniConf) error {
+	b, err := json.MarshalIndent(conf, "", "    ")
+	if err != nil {
+		return fmt.Errorf("marshal cni config error:%s", err.Error())
+	}
+	//cluster模式下地址块变化时会在运行中重写配置，运行时随时可能读到，不能让它看到写了一半的文件
+	//临时文件以点开头、不以.conf结尾，运行时加载配置时不会把它当成网络配置
+	if err = utils.WriteFileAtomic("/etc/cni/net.d/10-testcni.conf", b, 0766); err != nil {
+		return fmt.Errorf("CreateCniConfig error:%s", err.Error())
+	}
+	return nil
+}
+
+// getPodCidrs 双栈集群中PodCIDRs包含每个地址族的网段，旧版本只有PodCIDR
+func getPodCidrs(n *corev1.Node) []string {
+	if len(n.Spec.PodCIDRs) > 0 {
+		return n.Spec.PodCIDRs
+	}
+	if n.Spec.PodCIDR != "" {
+		return []string{n.Spec.PodCIDR}
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"github.com/vishvananda/netlink"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"test-cni/ipam"
+	"test-cni/nettools"
+)
+
+// peer 记录为其他节点写入的fdb、arp和路由，节点变化或删除时用来清理旧表项
+type peer struct {
+	hostIp   string
+	vxlanMac string
+	vxlanIps []string
+	podCidrs []string
+	//对端节点上ip池的网段
+	poolCidrs []string
+	//对端节点在cluster ipam模式下的地址块，这时不使用podCidrs
+	blockCidrs []string
+}
+
+func parsePeer(n *corev1.Node) (*peer, error) {
+	p := &peer{podCidrs: getPodCidrs(n)}
+
+	macToIp := n.Annotations["vxlan_mac_to_host_ip"]
+	macToIpArr := strings.Split(macToIp, "|")
+	if len(macToIpArr) != 2 {
+		return nil, fmt.Errorf("vxlan_mac_to_host_ip:%s incorrect", macToIp)
+	}
+	p.vxlanMac, p.hostIp = macToIpArr[0], macToIpArr[1]
+
+	ipToMacs := n.Annotations["vxlan_ip_to_vxlan_mac"]
+	for _, ipToMac := range strings.Split(ipToMacs, ",") {
+		ipToMacArr := strings.Split(ipToMac, "|")
+		if len(ipToMacArr) != 2 || ipToMacArr[1] != p.vxlanMac {
+			return nil, fmt.Errorf("vxlan_ip_to_vxlan_mac:%s incorrect", ipToMacs)
+		}
+		p.vxlanIps = append(p.vxlanIps, ipToMacArr[0])
+	}
+
+	var err error
+	if p.poolCidrs, err = parseCidrsAnnotation(n, poolCidrsAnnotation); err != nil {
+		return nil, err
+	}
+	if p.blockCidrs, err = parseCidrsAnnotation(n, blockCidrsAnnotation); err != nil {
+		return nil, err
+	}
+	//cluster ipam模式下PodCIDR即使被分配了也不会使用
+	if len(p.blockCidrs) > 0 {
+		p.podCidrs = nil
+	}
+	return p, nil
+}
+
+func parseCidrsAnnotation(n *corev1.Node, name string) ([]string, error) {
+	var res []string
+	for _, cidr := range strings.Split(n.Annotations[name], ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		if ipam.CidrToIpNet(cidr) == nil {
+			return nil, fmt.Errorf("%s:%s incorrect", name, n.Annotations[name])
+		}
+		res = append(res, cidr)
+	}
+	return res, nil
+}
+
+// routedCidrs ip池和地址块，每个网段一条经过vxlan设备的路由
+func (p *peer) routedCidrs() []string {
+	return append(append([]string{}, p.poolCidrs...), p.blockCidrs...)
+}
+
+// poolGw ip池和地址块的网段没有对应的vxlan地址，下一跳使用对端同一个地址族的vxlan设备地址
+func (p *peer) poolGw(cidr string) net.IP {
+	isV6 := ipam.IsIPv6Cidr(cidr)
+	for _, vxlanIp := range p.vxlanIps {
+		ip := net.ParseIP(vxlanIp)
+		if ip != nil && (ip.To4() == nil) == isV6 {
+			return ip
+		}
+	}
+	return nil
+}
+
+// peerManager 根据Node的变化维护到其他节点的fdb、arp和路由
+type peerManager struct {
+	vxlan       *netlink.Vxlan
+	currentNode string
+
+	mu    sync.Mutex
+	peers map[string]*peer
+}
+
+func newPeerManager(vxlan *netlink.Vxlan, currentNode string) *peerManager {
+	return &peerManager{
+		vxlan:       vxlan,
+		currentNode: currentNode,
+		peers:       make(map[string]*peer),
+	}
+}
+
+func (m *peerManager) handlers() cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if n, ok := obj.(*corev1.Node); ok {
+				m.sync(n)
+			}
+		},
+		//resync时也会走到这里，新旧对象相同，借此把被手动删掉的表项补回来
+		UpdateFunc: func(_, newObj interface{}) {
+			if n, ok := newObj.(*corev1.Node); ok {
+				m.sync(n)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if n, ok := obj.(*corev1.Node); ok {
+				m.remove(n.Name)
+			}
+		},
+	}
+}
+
+func (m *peerManager) sync(n *corev1.Node) {
+	if n.Name == m.currentNode {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, err := parsePeer(n)
+	if err != nil {
+		//节点上的daemonset可能还没写注解，等下一次更新
+		fmt.Println(fmt.Sprintf("skip node %s: %s", n.Name, err.Error()))
+		m.cleanLocked(n.Name)
+		return
+	}
+	if old, ok := m.peers[n.Name]; ok && !reflect.DeepEqual(old, p) {
+		m.cleanLocked(n.Name)
+	}
+	if err = m.ensure(p); err != nil {
+		fmt.Println(fmt.Sprintf("program node %s error:%s", n.Name, err.Error()))
+	}
+	m.peers[n.Name] = p
+}
+
+// setVxlan vxlan设备被重建之后，原来的表项都没了，需要全部重新写一遍
+func (m *peerManager) setVxlan(vxlan *netlink.Vxlan) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.vxlan = vxlan
+	for name, p := range m.peers {
+		if err := m.ensure(p); err != nil {
+			fmt.Println(fmt.Sprintf("program node %s error:%s", name, err.Error()))
+		}
+	}
+}
+
+func (m *peerManager) remove(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cleanLocked(name)
+}
+
+func (m *peerManager) ensure(p *peer) error {
+	err := nettools.CreateFdbEntry(p.vxlanMac, p.hostIp, m.vxlan.Name)
+	if err != nil {
+		return fmt.Errorf("CreateFdbEntry error:%s", err.Error())
+	}
+
+	for _, ip := range p.vxlanIps {
+		err = nettools.CreateArpEntry(ip, p.vxlanMac, m.vxlan.Name)
+		if err != nil {
+			return fmt.Errorf("CreateArpEntry error:%s", err.Error())
+		}
+	}
+
+	for _, cidr := range p.podCidrs {
+		otherGw := ipam.GetVxlanIp(cidr)
+		if otherGw == nil {
+			return fmt.Errorf("otherGw of %s can not be nil", cidr)
+		}
+		err = nettools.ReplaceRoute(ipam.CidrToIpNet(cidr), otherGw.IP, m.vxlan, int(netlink.FLAG_ONLINK))
+		if err != nil {
+			return fmt.Errorf("ReplaceRoute %s,%s error:%s", cidr, otherGw.IP, err.Error())
+		}
+	}
+
+	for _, cidr := range p.routedCidrs() {
+		poolGw := p.poolGw(cidr)
+		if poolGw == nil {
+			return fmt.Errorf("no vxlan ip in the same family as %s", cidr)
+		}
+		err = nettools.ReplaceRoute(ipam.CidrToIpNet(cidr), poolGw, m.vxlan, int(netlink.FLAG_ONLINK))
+		if err != nil {
+			return fmt.Errorf("ReplaceRoute %s,%s error:%s", cidr, poolGw, err.Error())
+		}
+	}
+	return nil
+}
+
+func (m *peerManager) cleanLocked(name string) {
+	p, ok := m.peers[name]
+	if !ok {
+		return
+	}
+	delete(m.peers, name)
+
+	for _, cidr := range p.podCidrs {
+		otherGw := ipam.GetVxlanIp(cidr)
+		if otherGw == nil {
+			continue
+		}
+		if err := nettools.DelRoute(ipam.CidrToIpNet(cidr), otherGw.IP, m.vxlan); err != nil {
+			fmt.Println(fmt.Sprintf("DelRoute %s of node %s error:%s", cidr, name, err.Error()))
+		}
+	}
+	for _, cidr := range p.routedCidrs() {
+		poolGw := p.poolGw(cidr)
+		if poolGw == nil {
+			continue
+		}
+		if err := nettools.DelRoute(ipam.CidrToIpNet(cidr), poolGw, m.vxlan); err != nil {
+			fmt.Println(fmt.Sprintf("DelRoute %s of node %s error:%s", cidr, name, err.Error()))
+		}
+	}
+	for _, ip := range p.vxlanIps {
+		if err := nettools.DelArpEntry(ip, m.vxlan.Name); err != nil {
+			fmt.Println(fmt.Sprintf("DelArpEntry %s of node %s error:%s", ip, name, err.Error()))
+		}
+	}
+	if err := nettools.DelFdbEntry(p.vxlanMac, p.hostIp, m.vxlan.Name); err != nil {
+		fmt.Println(fmt.Sprintf("DelFdbEntry %s of node %s error:%s", p.vxlanMac, name, err.Error()))
+	}
+}
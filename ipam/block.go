@@ -0,0 +1,231 @@
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"test-cni/utils"
+	"time"
+)
+
+// 集群ipam模式下，daemonset把集群网段切成小的地址块按需分给节点，插件只在本节点的地址块中分配
+
+// PickBlocks 每个地址族选一个地址块：请求了固定ip的选它所在的块，否则按顺序选第一个还有空闲ip的块
+// 调用方需要持有锁
+func PickBlocks(blocks []*Range, requested []net.IP, quarantine time.Duration) ([]*Range, error) {
+	var families []bool
+	byFamily := make(map[bool][]*Range)
+	for _, b := range blocks {
+		isV6 := IsIPv6Cidr(b.Subnet)
+		if _, ok := byFamily[isV6]; !ok {
+			families = append(families, isV6)
+		}
+		byFamily[isV6] = append(byFamily[isV6], b)
+	}
+
+	requestedByFamily := make(map[bool]net.IP)
+	for _, ip := range requested {
+		ip = normalizeIp(ip)
+		isV6 := ip.To4() == nil
+		if other, ok := requestedByFamily[isV6]; ok {
+			return nil, &RequestedIpError{Ip: ip.String(), Reason: fmt.Sprintf("and %s are in the same ip family", other)}
+		}
+		if _, ok := byFamily[isV6]; !ok {
+			return nil, &RequestedIpError{Ip: ip.String(), Reason: "is not in any block of this node"}
+		}
+		requestedByFamily[isV6] = ip
+	}
+
+	var res []*Range
+	for _, isV6 := range families {
+		var picked *Range
+		if ip, ok := requestedByFamily[isV6]; ok {
+			for _, r := range byFamily[isV6] {
+				if CidrToIpNet(r.Subnet).Contains(ip) {
+					picked = r
+					break
+				}
+			}
+			if picked == nil {
+				return nil, &RequestedIpError{Ip: ip.String(), Reason: fmt.Sprintf("is not in blocks %v", subnetsOf(byFamily[isV6]))}
+			}
+		} else {
+			for _, r := range byFamily[isV6] {
+				if getUnusedIp(r, quarantine) != nil {
+					picked = r
+					break
+				}
+			}
+			//daemonset发现剩余的ip不多时会申请新的地址块，这里只能先失败，等运行时重试
+			if picked == nil {
+				return nil, fmt.Errorf("no free ip in blocks %v, waiting for a new block", subnetsOf(byFamily[isV6]))
+			}
+		}
+		res = append(res, picked)
+	}
+	return res, nil
+}
+
+// NodeBlocksPath 本节点现在可以使用的地址块，daemonset在ipam锁内更新
+// 插件在拿锁之前读取cni配置，daemonset释放地址块之后，正在等锁的ADD不能再从旧配置里的块分配
+var NodeBlocksPath = ipStorageBasePath + "/blocks"
+
+// SetNodeBlocks 记录本节点可以使用的地址块，去掉地址块时调用方需要持有锁
+func SetNodeBlocks(blocks []string) error {
+	b, err := json.Marshal(blocks)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(NodeBlocksPath), 0766); err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(NodeBlocksPath, b, 0766)
+}
+
+// ActiveBlocks 去掉已经被daemonset释放的地址块，没有记录时原样返回，调用方需要持有锁
+func ActiveBlocks(blocks []*Range) ([]*Range, error) {
+	b, err := os.ReadFile(NodeBlocksPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return blocks, nil
+		}
+		return nil, err
+	}
+	var active []string
+	if err = json.Unmarshal(b, &active); err != nil {
+		return nil, fmt.Errorf("%s is not valid json:%s", NodeBlocksPath, err.Error())
+	}
+	var res []*Range
+	families := make(map[bool]bool)
+	for _, r := range blocks {
+		families[IsIPv6Cidr(r.Subnet)] = true
+		if utils.StringsIn(active, r.Subnet) {
+			res = append(res, r)
+		}
+	}
+	//一个地址族的块都被释放时不能只分配另一个地址族的ip
+	for _, r := range res {
+		delete(families, IsIPv6Cidr(r.Subnet))
+	}
+	if len(families) > 0 {
+		return nil, fmt.Errorf("all blocks in %v are released, waiting for a new block", subnetsOf(blocks))
+	}
+	return res, nil
+}
+
+// BlockUsage 返回地址块中可以自动分配的ip数、已经分配出去的ip数，以及空闲但还在quarantine中的ip数，调用方需要持有锁
+// quarantine中的ip暂时不会被分配，daemonset不能把它们算作剩余的ip
+func BlockUsage(r *Range, quarantine time.Duration) (capacity, used, quarantined int, err error) {
+	ipNet := CidrToIpNet(r.Subnet)
+	if ipNet == nil {
+		return 0, 0, 0, fmt.Errorf("invalid block:%s", r.Subnet)
+	}
+	capacity = rangeCapacity(r)
+
+	entries, err := os.ReadDir(IpStoragePath)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, 0, 0, err
+	}
+	inUse := make(map[string]bool)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if ip := net.ParseIP(e.Name()); ip != nil && ipNet.Contains(ip) {
+			inUse[e.Name()] = true
+			used++
+		}
+	}
+	if quarantine <= 0 {
+		return capacity, used, 0, nil
+	}
+	released, err := os.ReadDir(ReleasedStoragePath)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, 0, 0, err
+	}
+	for _, e := range released {
+		ip := net.ParseIP(e.Name())
+		if ip == nil || inUse[e.Name()] || r.reservedReason(normalizeIp(ip)) != "" {
+			continue
+		}
+		if at := releasedAt(e.Name()); !at.IsZero() && time.Since(at) < quarantine {
+			quarantined++
+		}
+	}
+	return capacity, used, quarantined, nil
+}
+
+// rangeCapacity 范围内可以自动分配的ip数：范围两端都包含在内，去掉网关、网络地址、广播地址和排除的网段
+func rangeCapacity(r *Range) int {
+	start, end := r.bounds()
+	first, last := new(big.Int).SetBytes(start), new(big.Int).SetBytes(end)
+	if first.Cmp(last) > 0 {
+		return 0
+	}
+	capacity := new(big.Int).Sub(last, first)
+	capacity.Add(capacity, big.NewInt(1))
+
+	var excludes []*net.IPNet
+	for _, cidr := range r.Exclude {
+		if ex := CidrToIpNet(cidr); ex != nil {
+			excludes = append(excludes, ex)
+		}
+	}
+	//网段之间只有包含和不相交两种关系，被其他排除网段包含（或者重复）的不再计算
+	covered := func(i int) bool {
+		ones, _ := excludes[i].Mask.Size()
+		for j, ex := range excludes {
+			if j == i || !ex.Contains(excludes[i].IP) {
+				continue
+			}
+			if exOnes, _ := ex.Mask.Size(); exOnes < ones || (exOnes == ones && j < i) {
+				return true
+			}
+		}
+		return false
+	}
+	for i, ex := range excludes {
+		if covered(i) {
+			continue
+		}
+		exFirst := new(big.Int).SetBytes(normalizeIp(ex.IP))
+		exLast := new(big.Int).SetBytes(normalizeIp(getLastIP(ex)))
+		if exFirst.Cmp(first) < 0 {
+			exFirst = first
+		}
+		if exLast.Cmp(last) > 0 {
+			exLast = last
+		}
+		if exFirst.Cmp(exLast) <= 0 {
+			capacity.Sub(capacity, new(big.Int).Sub(exLast, exFirst))
+			capacity.Sub(capacity, big.NewInt(1))
+		}
+	}
+	//范围包含网络地址、广播地址时同样不能分配，网关不会和它们相同
+	ipNet := CidrToIpNet(r.Subnet)
+	for _, ip := range []net.IP{r.GetGateway().IP, normalizeIp(ipNet.IP), normalizeIp(getLastIP(ipNet))} {
+		if ipBefore(ip, start) || ipBefore(end, ip) {
+			continue
+		}
+		var excluded bool
+		for _, ex := range excludes {
+			excluded = excluded || ex.Contains(ip)
+		}
+		if !excluded {
+			capacity.Sub(capacity, big.NewInt(1))
+		}
+	}
+	return int(capacity.Int64())
+}
+
+func subnetsOf(ranges []*Range) []string {
+	var res []string
+	for _, r := range ranges {
+		res = append(res, r.Subnet)
+	}
+	return res
+}
@@ -0,0 +1,186 @@
+package ipam
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func blockRanges(cidrs ...string) []*Range {
+	var res []*Range
+	for _, cidr := range cidrs {
+		res = append(res, &Range{Subnet: cidr})
+	}
+	return res
+}
+
+func TestPickBlocks(t *testing.T) {
+	cases := []struct {
+		name      string
+		blocks    []string
+		used      []string
+		requested []string
+		want      []string
+		err       string
+	}{
+		{"first block", []string{"10.244.0.0/30", "10.244.0.4/30"}, nil, nil, []string{"10.244.0.0/30"}, ""},
+		{"first block full", []string{"10.244.0.0/30", "10.244.0.4/30"}, []string{"10.244.0.2"}, nil, []string{"10.244.0.4/30"}, ""},
+		{"all blocks full", []string{"10.244.0.0/30", "10.244.0.4/30"}, []string{"10.244.0.2", "10.244.0.6"}, nil, nil, "no free ip in blocks"},
+		{"requested ip in second block", []string{"10.244.0.0/30", "10.244.0.4/30"}, nil, []string{"10.244.0.6"}, []string{"10.244.0.4/30"}, ""},
+		{"requested ip in full block", []string{"10.244.0.0/30", "10.244.0.4/30"}, []string{"10.244.0.6"}, []string{"10.244.0.6"}, []string{"10.244.0.4/30"}, ""},
+		{"requested ip not in blocks", []string{"10.244.0.0/30", "10.244.0.4/30"}, nil, []string{"10.244.1.2"}, nil, "is not in blocks"},
+		{"requested ip of other family", []string{"10.244.0.0/30"}, nil, []string{"fd00::2"}, nil, "is not in any block of this node"},
+		{"two requested ips of one family", []string{"10.244.0.0/30", "10.244.0.4/30"}, nil, []string{"10.244.0.2", "10.244.0.6"}, nil, "same ip family"},
+		{"dual stack", []string{"10.244.0.0/30", "fd00::/126", "fd00::4/126"}, []string{"fd00::2"}, nil, []string{"10.244.0.0/30", "fd00::4/126"}, ""},
+		{"dual stack requested v4 only", []string{"10.244.0.0/30", "10.244.0.4/30", "fd00::/126"}, nil, []string{"10.244.0.6"}, []string{"10.244.0.4/30", "fd00::/126"}, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			useTempStorage(t)
+			reserveIps(t, c.used...)
+			var requested []net.IP
+			for _, ip := range c.requested {
+				requested = append(requested, net.ParseIP(ip))
+			}
+			picked, err := PickBlocks(blockRanges(c.blocks...), requested, 0)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("PickBlocks() error = %v, want %q", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("PickBlocks() error = %v", err)
+			}
+			if got := subnetsOf(picked); strings.Join(got, ",") != strings.Join(c.want, ",") {
+				t.Fatalf("PickBlocks() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestActiveBlocks(t *testing.T) {
+	useTempStorage(t)
+	blocks := blockRanges("10.244.0.0/26", "10.244.0.64/26", "fd00::/122")
+
+	//daemonset还没写过列表时原样返回
+	active, err := ActiveBlocks(blocks)
+	if err != nil || len(active) != 3 {
+		t.Fatalf("ActiveBlocks() without list = %v, %v, want all blocks", subnetsOf(active), err)
+	}
+
+	if err = SetNodeBlocks([]string{"10.244.0.0/26", "fd00::/122", "10.244.1.0/26"}); err != nil {
+		t.Fatal(err)
+	}
+	active, err = ActiveBlocks(blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(subnetsOf(active), ","); got != "10.244.0.0/26,fd00::/122" {
+		t.Fatalf("ActiveBlocks() = %s, want 10.244.0.0/26,fd00::/122", got)
+	}
+
+	//一个地址族的块都被释放了
+	if err = SetNodeBlocks([]string{"10.244.0.0/26"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ActiveBlocks(blocks); err == nil || !strings.Contains(err.Error(), "waiting for a new block") {
+		t.Fatalf("ActiveBlocks() error = %v, want waiting for a new block", err)
+	}
+}
+
+func TestBlockUsage(t *testing.T) {
+	cases := []struct {
+		name     string
+		r        Range
+		used     []string
+		capacity int
+		wantUsed int
+	}{
+		{"v4 /26", Range{Subnet: "10.244.0.0/26"}, nil, 61, 0},
+		{"v4 /30", Range{Subnet: "10.244.0.0/30"}, nil, 1, 0},
+		{"used ips", Range{Subnet: "10.244.0.64/26"}, []string{"10.244.0.66", "10.244.0.100", "10.244.0.2", "10.244.1.66"}, 61, 2},
+		{"exclude at the end", Range{Subnet: "10.244.0.0/26", Exclude: []string{"10.244.0.48/28"}}, nil, 46, 0},
+		{"exclude whole block", Range{Subnet: "10.244.0.0/26", Exclude: []string{"10.244.0.0/26"}}, nil, 0, 0},
+		{"exclude covering gateway", Range{Subnet: "10.244.0.0/26", Exclude: []string{"10.244.0.0/27"}}, nil, 31, 0},
+		{"nested excludes", Range{Subnet: "10.244.0.0/26", Exclude: []string{"10.244.0.16/28", "10.244.0.0/27", "10.244.0.20/30"}}, nil, 31, 0},
+		{"duplicate excludes", Range{Subnet: "10.244.0.0/26", Exclude: []string{"10.244.0.48/28", "10.244.0.48/28"}}, nil, 46, 0},
+		{"disjoint excludes", Range{Subnet: "10.244.0.0/26", Exclude: []string{"10.244.0.8/29", "10.244.0.32/29"}}, nil, 45, 0},
+		{"v6 /122", Range{Subnet: "fd00::/122"}, []string{"fd00::5"}, 61, 1},
+		{"v6 /96", Range{Subnet: "fd00::/96"}, nil, 1<<32 - 3, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			useTempStorage(t)
+			reserveIps(t, c.used...)
+			//写临时文件时留下的隐藏文件不算
+			reserveIps(t, ".10.244.0.3.tmp")
+			capacity, used, quarantined, err := BlockUsage(&c.r, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if capacity != c.capacity || used != c.wantUsed || quarantined != 0 {
+				t.Fatalf("BlockUsage() = %d, %d, %d, want %d, %d, 0", capacity, used, quarantined, c.capacity, c.wantUsed)
+			}
+		})
+	}
+}
+
+// TestRangeCapacity 小网段逐个ip检查，容量必须和分配器实际能分配的ip数一致
+func TestRangeCapacity(t *testing.T) {
+	ranges := []Range{
+		{Subnet: "10.244.0.0/27"},
+		{Subnet: "10.244.0.0/27", Gateway: "10.244.0.30"},
+		{Subnet: "10.244.0.0/27", RangeStart: "10.244.0.0", RangeEnd: "10.244.0.31"},
+		{Subnet: "10.244.0.0/27", RangeStart: "10.244.0.5", RangeEnd: "10.244.0.20", Exclude: []string{"10.244.0.0/29", "10.244.0.16/30"}},
+		{Subnet: "10.244.0.0/27", Exclude: []string{"10.244.0.0/28", "10.244.0.4/30", "10.244.0.0/28"}},
+		{Subnet: "10.244.0.0/27", Gateway: "10.244.0.9", Exclude: []string{"10.244.0.8/29"}},
+		{Subnet: "fd00::/123", Exclude: []string{"fd00::10/124"}},
+	}
+	for _, r := range ranges {
+		ipNet := CidrToIpNet(r.Subnet)
+		start, end := r.bounds()
+		var want int
+		for ip := start; ; ip = nextIP(ip) {
+			if ipNet.Contains(ip) && r.reservedReason(ip) == "" {
+				want++
+			}
+			if ip.Equal(end) {
+				break
+			}
+		}
+		if got := rangeCapacity(&r); got != want {
+			t.Errorf("rangeCapacity(%+v) = %d, want %d", r, got, want)
+		}
+	}
+}
+
+func TestBlockUsageQuarantine(t *testing.T) {
+	useTempStorage(t)
+	r := &Range{Subnet: "10.244.0.0/26", Exclude: []string{"10.244.0.48/28"}}
+	reserveIps(t, "10.244.0.2", "10.244.0.3")
+	//刚释放的.4、.5在quarantine中；.3释放之后又被分配了；.50被排除；.70不在这个块
+	for _, ip := range []string{"10.244.0.3", "10.244.0.4", "10.244.0.5", "10.244.0.50", "10.244.0.70"} {
+		markReleased(ip)
+	}
+	//.6释放得早，已经过了quarantine
+	markReleased("10.244.0.6")
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(ReleasedStoragePath+"/10.244.0.6", old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	capacity, used, quarantined, err := BlockUsage(r, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if capacity != 46 || used != 2 || quarantined != 2 {
+		t.Fatalf("BlockUsage() = %d, %d, %d, want 46, 2, 2", capacity, used, quarantined)
+	}
+	//不开quarantine时都算空闲
+	if _, _, quarantined, _ = BlockUsage(r, 0); quarantined != 0 {
+		t.Fatalf("BlockUsage() without quarantine counted %d quarantined ips", quarantined)
+	}
+}
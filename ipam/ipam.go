@@ -4,30 +4,18 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strings"
 	"test-cni/utils"
+	"time"
 )
 
-const ipStorageBasePath = "/root/k8s_cni_ip_storage"
-const IpStoragePath = ipStorageBasePath + "/ips"
-const ContainerIdStoragePath = ipStorageBasePath + "/container_ids"
+// ip存储的目录，测试时指向临时目录
+var ipStorageBasePath = "/root/k8s_cni_ip_storage"
+var IpStoragePath = ipStorageBasePath + "/ips"
 
+// GetUnusedIp 不考虑quarantine，从上一次分配的ip后面开始在整个子网中找空闲ip
 func GetUnusedIp(cidr string) *net.IPNet {
-	_, ipNet, err := net.ParseCIDR(cidr)
-	if err != nil {
-		return nil
-	}
-	firstIP := nextIP(ipNet.IP.Mask(ipNet.Mask))
-	lastIP := getLastIP(ipNet)
-
-	for ip := nextIP(firstIP); !ip.Equal(lastIP); ip = nextIP(ip) {
-		if utils.FileIsExisted(fmt.Sprintf("%s/%s", IpStoragePath, ip.String())) {
-			continue
-		}
-		return &net.IPNet{
-			IP: ip, Mask: ipNet.Mask,
-		}
-	}
-	return nil
+	return getUnusedIp(&Range{Subnet: cidr}, 0)
 }
 
 func GetGateway(cidr string) *net.IPNet {
@@ -61,14 +49,291 @@ func GetVxlanIp(cidr string) *net.IPNet {
 	}
 }
 
+// CheckOverlap 检查网段之间互不重叠，插件和daemonset用同样的规则校验pod网段和ip池
+func CheckOverlap(cidrs []string) error {
+	for i := range cidrs {
+		a := CidrToIpNet(cidrs[i])
+		if a == nil {
+			return fmt.Errorf("invalid cidr:%s", cidrs[i])
+		}
+		for j := i + 1; j < len(cidrs); j++ {
+			b := CidrToIpNet(cidrs[j])
+			if b == nil {
+				return fmt.Errorf("invalid cidr:%s", cidrs[j])
+			}
+			if a.Contains(b.IP) || b.Contains(a.IP) {
+				return fmt.Errorf("subnet %s overlaps %s", cidrs[i], cidrs[j])
+			}
+		}
+	}
+	return nil
+}
+
+// IsIPv6Cidr 判断cidr是不是ipv6网段
+func IsIPv6Cidr(cidr string) bool {
+	ipNet := CidrToIpNet(cidr)
+	return ipNet != nil && ipNet.IP.To4() == nil
+}
+
+// Allocator 在调用方持有锁的前提下分配ip，返回之前attachment记录已经落盘
+// 双栈时每个范围（每个地址族）各分配一个ip
+type Allocator struct {
+	Ranges []*Range
+	//请求的固定ip，每个子网最多一个，没有请求固定ip的子网自动分配
+	//固定ip可以在RangeStart、RangeEnd之外，但不能是网关或者被排除的ip
+	Requested []net.IP
+	//释放之后多久才能再被自动分配，为0时不限制，固定ip不受影响
+	Quarantine time.Duration
+}
+
+// RequestedIpError 请求的固定ip不能使用，Conflict表示ip已经被别的容器占用
+type RequestedIpError struct {
+	Ip       string
+	Reason   string
+	Conflict bool
+}
+
+func (e *RequestedIpError) Error() string {
+	return fmt.Sprintf("requested ip %s %s", e.Ip, e.Reason)
+}
+
+func NewAllocator(ranges ...*Range) *Allocator {
+	return &Allocator{Ranges: ranges}
+}
+
+// Allocate 为att描述的容器网卡选出空闲ip，填好att.Ips和CreatedAt之后原子地写入记录
+func (a *Allocator) Allocate(att *Attachment) (ips []*net.IPNet, err error) {
+	//按规范同一个容器网卡不会在没有DEL的情况下ADD两次，已有的记录是上一次失败的ADD留下的
+	if err = Release(att.ContainerId, att.IfName); err != nil {
+		return nil, fmt.Errorf("release stale attachment error:%s", err.Error())
+	}
+
+	key := attachmentKey(att.ContainerId, att.IfName)
+	var ipFiles []string
+	defer func() {
+		if err != nil {
+			for _, f := range ipFiles {
+				_ = utils.DeleteFile(f)
+			}
+		}
+	}()
+
+	requested, err := a.requestedByRange()
+	if err != nil {
+		return nil, err
+	}
+
+	att.Ips = nil
+	lastReserved := make(map[string]net.IP)
+	for _, r := range a.Ranges {
+		var podIP *net.IPNet
+		if ip, ok := requested[r]; ok {
+			if podIP, err = checkRequestedIp(r, ip); err != nil {
+				return nil, err
+			}
+		} else if podIP = getUnusedIp(r, a.Quarantine); podIP == nil {
+			return nil, fmt.Errorf("can not allocation ip address from subnet:%s", r.Subnet)
+		} else {
+			lastReserved[r.Subnet] = podIP.IP
+		}
+		//ip文件中记录占用者的key，分配时只看文件是否存在
+		ipFile := fmt.Sprintf("%s/%s", IpStoragePath, podIP.IP.String())
+		err = utils.WriteFileAtomic(ipFile, []byte(key), 0766)
+		if err != nil {
+			return nil, fmt.Errorf("write ip file %s error:%s", ipFile, err.Error())
+		}
+		ipFiles = append(ipFiles, ipFile)
+		ips = append(ips, podIP)
+
+		attIp := AttachmentIp{Address: podIP.String(), Subnet: r.Subnet}
+		if gw := r.GetGateway(); gw != nil {
+			attIp.Gateway = gw.IP.String()
+		}
+		att.Ips = append(att.Ips, attIp)
+	}
+
+	att.CreatedAt = time.Now()
+	if err = writeAttachment(att); err != nil {
+		return nil, err
+	}
+
+	//记录已经落盘，下面的失败只影响下一次从哪里开始分配
+	for _, ip := range ips {
+		clearReleased(ip.IP.String())
+	}
+	for subnet, ip := range lastReserved {
+		_ = setLastReserved(subnet, ip)
+	}
+	return ips, nil
+}
+
+// requestedByRange 把请求的固定ip按所在的子网分组，不在任何子网中或者同一个子网请求了多个都是错误
+func (a *Allocator) requestedByRange() (map[*Range]net.IP, error) {
+	res := make(map[*Range]net.IP)
+	var subnets []string
+	for _, r := range a.Ranges {
+		subnets = append(subnets, r.Subnet)
+	}
+	for _, ip := range a.Requested {
+		ip = normalizeIp(ip)
+		var found bool
+		for _, r := range a.Ranges {
+			ipNet := CidrToIpNet(r.Subnet)
+			if ipNet == nil || !ipNet.Contains(ip) {
+				continue
+			}
+			if other, ok := res[r]; ok {
+				return nil, &RequestedIpError{Ip: ip.String(), Reason: fmt.Sprintf("and %s are both in subnet %s", other, r.Subnet)}
+			}
+			res[r] = ip
+			found = true
+			break
+		}
+		if !found {
+			return nil, &RequestedIpError{Ip: ip.String(), Reason: fmt.Sprintf("is not in subnets %v", subnets)}
+		}
+	}
+	return res, nil
+}
+
+// checkRequestedIp 网络地址、网关、广播地址和被排除的ip不分配，已经被占用的ip也不能再用
+func checkRequestedIp(r *Range, ip net.IP) (*net.IPNet, error) {
+	if reason := r.reservedReason(ip); reason != "" {
+		return nil, &RequestedIpError{Ip: ip.String(), Reason: reason}
+	}
+	b, err := os.ReadFile(fmt.Sprintf("%s/%s", IpStoragePath, ip.String()))
+	if err == nil {
+		return nil, &RequestedIpError{Ip: ip.String(), Reason: fmt.Sprintf("is already reserved by %s", string(b)), Conflict: true}
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return &net.IPNet{IP: ip, Mask: CidrToIpNet(r.Subnet).Mask}, nil
+}
+
+// Release 删除容器网卡对应的attachment记录和ip，记录不存在时返回nil
+func Release(containerId, ifName string) error {
+	att, err := GetAttachment(containerId, ifName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	//先删ip再删记录，中途失败时记录还在，可以再次释放
+	if err = releaseIps(attachmentKey(containerId, ifName), att.IpStrs()); err != nil {
+		return err
+	}
+	return utils.DeleteFile(attachmentFile(attachmentKey(containerId, ifName)))
+}
+
+// releaseIps 删除属于key的ip文件，已经被别人占用的ip不动
+func releaseIps(key string, ips []string) error {
+	for _, ip := range ips {
+		ipFile := fmt.Sprintf("%s/%s", IpStoragePath, ip)
+		b, err := os.ReadFile(ipFile)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if string(b) != key {
+			continue
+		}
+		if err = utils.DeleteFile(ipFile); err != nil {
+			return err
+		}
+		markReleased(ip)
+	}
+	return nil
+}
+
+// Reservation 一个容器网卡占用的ip，ContainerId为空表示找不到对应记录的孤儿ip（比如分配到一半进程被杀）
+type Reservation struct {
+	ContainerId string
+	IfName      string
+	//分配时的网络名，多个插件共用存储时用来区分，旧版本的记录为空
+	Network   string
+	Ips       []string
+	CreatedAt time.Time
+}
+
+// ListReservations 列出存储中的所有预留记录，调用方需要持有锁
+func ListReservations() ([]*Reservation, error) {
+	var res []*Reservation
+	owned := make(map[string]bool)
+	atts, err := ListAttachments()
+	if err != nil {
+		return nil, err
+	}
+	for _, att := range atts {
+		owned[attachmentKey(att.ContainerId, att.IfName)] = true
+		res = append(res, &Reservation{ContainerId: att.ContainerId, IfName: att.IfName, Network: att.Network, Ips: att.IpStrs(), CreatedAt: att.CreatedAt})
+	}
+
+	entries, err := os.ReadDir(IpStoragePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range entries {
+		//跳过WriteFileAtomic留下的临时文件
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		b, err := os.ReadFile(fmt.Sprintf("%s/%s", IpStoragePath, e.Name()))
+		if err != nil || owned[string(b)] {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		res = append(res, &Reservation{Ips: []string{e.Name()}, CreatedAt: info.ModTime()})
+	}
+	return res, nil
+}
+
+// ReleaseReservation 释放ListReservations返回的记录，调用方需要持有锁
+func ReleaseReservation(r *Reservation) error {
+	if r.ContainerId != "" {
+		return Release(r.ContainerId, r.IfName)
+	}
+	for _, ip := range r.Ips {
+		if err := utils.DeleteFile(fmt.Sprintf("%s/%s", IpStoragePath, ip)); err != nil {
+			return err
+		}
+		markReleased(ip)
+	}
+	return nil
+}
+
+// CheckWritable 在存储目录里写一个临时文件再删掉，确认ipam存储可写
+func CheckWritable() error {
+	for _, dir := range []string{IpStoragePath, AttachmentStoragePath} {
+		f, err := os.CreateTemp(dir, ".probe")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		if err = os.Remove(f.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReleaseIp 释放容器所有网卡的ip
 func ReleaseIp(containerId string) {
-	containerIdFile := fmt.Sprintf("%s/%s", ContainerIdStoragePath, containerId)
-	b, err := os.ReadFile(containerIdFile)
+	atts, err := ListAttachments()
 	if err != nil {
 		return
 	}
-	_ = utils.DeleteFile(fmt.Sprintf("%s/%s", IpStoragePath, string(b)))
-	_ = utils.DeleteFile(fmt.Sprintf("%s/%s", ContainerIdStoragePath, containerId))
+	for _, att := range atts {
+		if att.ContainerId == containerId {
+			_ = Release(att.ContainerId, att.IfName)
+		}
+	}
 }
 
 func nextIP(ip net.IP) net.IP {
@@ -84,10 +349,24 @@ func nextIP(ip net.IP) net.IP {
 }
 
 func getLastIP(ipNet *net.IPNet) net.IP {
-	lastIP := make(net.IP, len(ipNet.IP))
-	copy(lastIP, ipNet.IP.To4())
+	ip := ipNet.IP.To4()
+	if ip == nil || len(ipNet.Mask) == net.IPv6len {
+		ip = ipNet.IP.To16()
+	}
+	lastIP := make(net.IP, len(ip))
+	copy(lastIP, ip)
 	for i := range lastIP {
 		lastIP[i] |= ^ipNet.Mask[i]
 	}
 	return lastIP
 }
+
+func splitIps(content string) []string {
+	var ips []string
+	for _, ip := range strings.Split(content, "\n") {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
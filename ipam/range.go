@@ -0,0 +1,143 @@
+package ipam
+
+import (
+	"fmt"
+	"net"
+)
+
+// Range 一个子网以及其中可以自动分配的范围
+// RangeStart、RangeEnd不填时使用子网中第一个和倒数第二个ip，网络地址（vxlan设备的地址）、网关和Exclude中的ip都不会分配
+type Range struct {
+	Subnet     string   `json:"subnet"`
+	RangeStart string   `json:"rangeStart,omitempty"`
+	RangeEnd   string   `json:"rangeEnd,omitempty"`
+	Exclude    []string `json:"exclude,omitempty"`
+	//网关，不填时使用子网中的第一个ip
+	Gateway string `json:"gateway,omitempty"`
+}
+
+// Validate 检查范围、网关和排除的网段都在子网内
+func (r *Range) Validate() error {
+	ipNet := CidrToIpNet(r.Subnet)
+	if ipNet == nil {
+		return fmt.Errorf("invalid subnet:%s", r.Subnet)
+	}
+	ips := map[string]string{"rangeStart": r.RangeStart, "rangeEnd": r.RangeEnd, "gateway": r.Gateway}
+	for _, name := range []string{"rangeStart", "rangeEnd", "gateway"} {
+		if ips[name] == "" {
+			continue
+		}
+		ip := net.ParseIP(ips[name])
+		if ip == nil {
+			return fmt.Errorf("invalid %s:%s", name, ips[name])
+		}
+		if !ipNet.Contains(ip) {
+			return fmt.Errorf("%s %s is not in subnet %s", name, ips[name], r.Subnet)
+		}
+	}
+	start, end := r.bounds()
+	if ipBefore(end, start) {
+		return fmt.Errorf("range %s-%s of subnet %s is empty", start, end, r.Subnet)
+	}
+	for _, cidr := range r.Exclude {
+		exclude := CidrToIpNet(cidr)
+		if exclude == nil {
+			return fmt.Errorf("invalid exclude:%s", cidr)
+		}
+		if !netContains(ipNet, exclude) {
+			return fmt.Errorf("exclude %s is not in subnet %s", cidr, r.Subnet)
+		}
+	}
+	//网络地址是vxlan设备的地址，不能当网关
+	gw := r.GetGateway().IP
+	if gw.Equal(ipNet.IP.Mask(ipNet.Mask)) || gw.Equal(getLastIP(ipNet)) {
+		return fmt.Errorf("gateway %s can not be the network or broadcast address of %s", gw, r.Subnet)
+	}
+	return nil
+}
+
+// GetGateway 返回带子网掩码的网关
+func (r *Range) GetGateway() *net.IPNet {
+	gw := GetGateway(r.Subnet)
+	if gw != nil && r.Gateway != "" {
+		gw.IP = normalizeIp(net.ParseIP(r.Gateway))
+	}
+	return gw
+}
+
+// bounds 返回可以自动分配的第一个和最后一个ip，都包含在内
+func (r *Range) bounds() (net.IP, net.IP) {
+	ipNet := CidrToIpNet(r.Subnet)
+	start := nextIP(ipNet.IP.Mask(ipNet.Mask))
+	if r.RangeStart != "" {
+		start = normalizeIp(net.ParseIP(r.RangeStart))
+	}
+	end := prevIP(getLastIP(ipNet))
+	if r.RangeEnd != "" {
+		end = normalizeIp(net.ParseIP(r.RangeEnd))
+	}
+	return start, end
+}
+
+// reservedReason 返回ip不能分配给pod的原因，可以分配时返回空字符串，不检查是否已经被占用
+func (r *Range) reservedReason(ip net.IP) string {
+	ipNet := CidrToIpNet(r.Subnet)
+	switch {
+	case !ipNet.Contains(ip):
+		return fmt.Sprintf("is not in subnet %s", r.Subnet)
+	case ip.Equal(ipNet.IP.Mask(ipNet.Mask)):
+		return "is the network address"
+	case ip.Equal(getLastIP(ipNet)):
+		return "is the broadcast address"
+	case ip.Equal(r.GetGateway().IP):
+		return "is the gateway"
+	}
+	for _, cidr := range r.Exclude {
+		if exclude := CidrToIpNet(cidr); exclude != nil && exclude.Contains(ip) {
+			return fmt.Sprintf("is excluded by %s", cidr)
+		}
+	}
+	return ""
+}
+
+// excludeEnd ip在排除的网段中时返回包含它的最大网段的最后一个ip，否则返回nil
+func (r *Range) excludeEnd(ip net.IP) net.IP {
+	var end net.IP
+	for _, cidr := range r.Exclude {
+		exclude := CidrToIpNet(cidr)
+		if exclude == nil || !exclude.Contains(ip) {
+			continue
+		}
+		if last := normalizeIp(getLastIP(exclude)); end == nil || ipBefore(end, last) {
+			end = last
+		}
+	}
+	return end
+}
+
+// netContains 判断inner是否完全在outer之内
+func netContains(outer, inner *net.IPNet) bool {
+	outerOnes, outerBits := outer.Mask.Size()
+	innerOnes, innerBits := inner.Mask.Size()
+	return outerBits == innerBits && innerOnes >= outerOnes && outer.Contains(inner.IP)
+}
+
+// normalizeIp ipv4统一用4字节表示，和子网中的ip保持一样的长度
+func normalizeIp(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
+
+func prevIP(ip net.IP) net.IP {
+	prev := make(net.IP, len(ip))
+	copy(prev, ip)
+	for i := len(prev) - 1; i >= 0; i-- {
+		prev[i]--
+		if prev[i] != 0xff {
+			break
+		}
+	}
+	return prev
+}
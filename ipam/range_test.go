@@ -0,0 +1,255 @@
+package ipam
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTempStorage 把ip存储指向临时目录，测试结束后恢复
+func useTempStorage(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	oldIp, oldAttachment, oldContainerId := IpStoragePath, AttachmentStoragePath, ContainerIdStoragePath
+	oldLastReserved, oldReleased, oldNodeBlocks := LastReservedStoragePath, ReleasedStoragePath, NodeBlocksPath
+	IpStoragePath = dir + "/ips"
+	AttachmentStoragePath = dir + "/attachments"
+	ContainerIdStoragePath = dir + "/container_ids"
+	LastReservedStoragePath = dir + "/last_reserved"
+	ReleasedStoragePath = dir + "/released"
+	NodeBlocksPath = dir + "/blocks"
+	t.Cleanup(func() {
+		IpStoragePath, AttachmentStoragePath, ContainerIdStoragePath = oldIp, oldAttachment, oldContainerId
+		LastReservedStoragePath, ReleasedStoragePath, NodeBlocksPath = oldLastReserved, oldReleased, oldNodeBlocks
+	})
+	for _, d := range []string{IpStoragePath, AttachmentStoragePath} {
+		if err := os.MkdirAll(d, 0766); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// reserveIps 模拟已经分配出去的ip
+func reserveIps(t *testing.T, ips ...string) {
+	t.Helper()
+	for _, ip := range ips {
+		if err := os.WriteFile(IpStoragePath+"/"+ip, nil, 0766); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRangeValidate(t *testing.T) {
+	cases := []struct {
+		name string
+		r    Range
+		err  string
+	}{
+		{"v4 subnet", Range{Subnet: "10.244.1.0/24"}, ""},
+		{"v6 subnet", Range{Subnet: "fd00:10:244:1::/64"}, ""},
+		{"invalid subnet", Range{Subnet: "10.244.1.0"}, "invalid subnet"},
+		{"range in subnet", Range{Subnet: "10.244.1.0/24", RangeStart: "10.244.1.10", RangeEnd: "10.244.1.20"}, ""},
+		{"single ip range", Range{Subnet: "10.244.1.0/24", RangeStart: "10.244.1.10", RangeEnd: "10.244.1.10"}, ""},
+		{"range start at network address", Range{Subnet: "10.244.1.0/24", RangeStart: "10.244.1.0"}, ""},
+		{"range end at broadcast address", Range{Subnet: "10.244.1.0/24", RangeEnd: "10.244.1.255"}, ""},
+		{"invalid range start", Range{Subnet: "10.244.1.0/24", RangeStart: "10.244.1"}, "invalid rangeStart"},
+		{"range start out of subnet", Range{Subnet: "10.244.1.0/24", RangeStart: "10.244.2.1"}, "rangeStart 10.244.2.1 is not in subnet"},
+		{"range end out of subnet", Range{Subnet: "10.244.1.0/24", RangeEnd: "10.244.0.255"}, "rangeEnd 10.244.0.255 is not in subnet"},
+		{"empty range", Range{Subnet: "10.244.1.0/24", RangeStart: "10.244.1.20", RangeEnd: "10.244.1.10"}, "is empty"},
+		{"v6 range start in v4 subnet", Range{Subnet: "10.244.1.0/24", RangeStart: "fd00::1"}, "is not in subnet"},
+		{"/31 has no ip", Range{Subnet: "10.244.1.0/31"}, "is empty"},
+		{"/32 has no ip", Range{Subnet: "10.244.1.0/32"}, "is empty"},
+		{"/127 has no ip", Range{Subnet: "fd00::/127"}, "is empty"},
+		{"/30", Range{Subnet: "10.244.1.0/30"}, ""},
+		{"exclude in subnet", Range{Subnet: "10.244.1.0/24", Exclude: []string{"10.244.1.128/25"}}, ""},
+		{"exclude whole subnet", Range{Subnet: "10.244.1.0/24", Exclude: []string{"10.244.1.0/24"}}, ""},
+		{"exclude larger than subnet", Range{Subnet: "10.244.1.0/24", Exclude: []string{"10.244.0.0/23"}}, "exclude 10.244.0.0/23 is not in subnet"},
+		{"exclude out of subnet", Range{Subnet: "10.244.1.0/24", Exclude: []string{"10.244.2.0/25"}}, "is not in subnet"},
+		{"exclude of other family", Range{Subnet: "10.244.1.0/24", Exclude: []string{"fd00::/120"}}, "is not in subnet"},
+		{"invalid exclude", Range{Subnet: "10.244.1.0/24", Exclude: []string{"10.244.1.1"}}, "invalid exclude"},
+		{"gateway override", Range{Subnet: "10.244.1.0/24", Gateway: "10.244.1.254"}, ""},
+		{"invalid gateway", Range{Subnet: "10.244.1.0/24", Gateway: "gw"}, "invalid gateway"},
+		{"gateway out of subnet", Range{Subnet: "10.244.1.0/24", Gateway: "10.244.2.1"}, "gateway 10.244.2.1 is not in subnet"},
+		{"gateway at network address", Range{Subnet: "10.244.1.0/24", Gateway: "10.244.1.0"}, "network or broadcast"},
+		{"gateway at broadcast address", Range{Subnet: "10.244.1.0/24", Gateway: "10.244.1.255"}, "network or broadcast"},
+		{"v6 gateway at network address", Range{Subnet: "fd00::/120", Gateway: "fd00::"}, "network or broadcast"},
+		{"v6 gateway at last address", Range{Subnet: "fd00::/120", Gateway: "fd00::ff"}, "network or broadcast"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.r.Validate()
+			if c.err == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("Validate() = %v, want error containing %q", err, c.err)
+			}
+		})
+	}
+}
+
+func TestRangeBounds(t *testing.T) {
+	cases := []struct {
+		name       string
+		r          Range
+		start, end string
+	}{
+		{"v4 default", Range{Subnet: "10.244.1.0/24"}, "10.244.1.1", "10.244.1.254"},
+		{"v4 subnet not aligned", Range{Subnet: "10.244.1.77/24"}, "10.244.1.1", "10.244.1.254"},
+		{"v4 range", Range{Subnet: "10.244.1.0/24", RangeStart: "10.244.1.10", RangeEnd: "10.244.1.20"}, "10.244.1.10", "10.244.1.20"},
+		{"v4 only start", Range{Subnet: "10.244.1.0/24", RangeStart: "10.244.1.100"}, "10.244.1.100", "10.244.1.254"},
+		{"v4 only end", Range{Subnet: "10.244.1.0/24", RangeEnd: "10.244.1.100"}, "10.244.1.1", "10.244.1.100"},
+		{"v4 across octet", Range{Subnet: "10.244.0.0/23"}, "10.244.0.1", "10.244.1.254"},
+		{"v4-mapped v6 range start", Range{Subnet: "10.244.1.0/24", RangeStart: "::ffff:10.244.1.10"}, "10.244.1.10", "10.244.1.254"},
+		{"v6 default", Range{Subnet: "fd00::/120"}, "fd00::1", "fd00::fe"},
+		{"v6 range", Range{Subnet: "fd00::/64", RangeStart: "fd00::100", RangeEnd: "fd00::1ff"}, "fd00::100", "fd00::1ff"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			start, end := c.r.bounds()
+			if start.String() != c.start || end.String() != c.end {
+				t.Fatalf("bounds() = %s-%s, want %s-%s", start, end, c.start, c.end)
+			}
+			//ipv4必须是4字节，否则和子网中的ip比较、递增时会出错
+			wantLen := net.IPv6len
+			if net.ParseIP(c.start).To4() != nil {
+				wantLen = net.IPv4len
+			}
+			if len(start) != wantLen || len(end) != wantLen {
+				t.Fatalf("bounds() length = %d-%d, want %d", len(start), len(end), wantLen)
+			}
+		})
+	}
+}
+
+func TestRangeReservedReason(t *testing.T) {
+	cases := []struct {
+		name   string
+		r      Range
+		ip     string
+		reason string
+	}{
+		{"free ip", Range{Subnet: "10.244.1.0/24"}, "10.244.1.2", ""},
+		{"network address", Range{Subnet: "10.244.1.0/24"}, "10.244.1.0", "network address"},
+		{"broadcast address", Range{Subnet: "10.244.1.0/24"}, "10.244.1.255", "broadcast address"},
+		{"default gateway", Range{Subnet: "10.244.1.0/24"}, "10.244.1.1", "gateway"},
+		{"gateway override", Range{Subnet: "10.244.1.0/24", Gateway: "10.244.1.254"}, "10.244.1.254", "gateway"},
+		{"first ip with gateway override", Range{Subnet: "10.244.1.0/24", Gateway: "10.244.1.254"}, "10.244.1.1", ""},
+		{"excluded", Range{Subnet: "10.244.1.0/24", Exclude: []string{"10.244.1.128/25"}}, "10.244.1.200", "excluded by 10.244.1.128/25"},
+		{"first excluded ip", Range{Subnet: "10.244.1.0/24", Exclude: []string{"10.244.1.128/25"}}, "10.244.1.128", "excluded"},
+		{"before exclude", Range{Subnet: "10.244.1.0/24", Exclude: []string{"10.244.1.128/25"}}, "10.244.1.127", ""},
+		{"out of subnet", Range{Subnet: "10.244.1.0/24"}, "10.244.2.1", "is not in subnet"},
+		{"v6 network address", Range{Subnet: "fd00::/120"}, "fd00::", "network address"},
+		{"v6 last address", Range{Subnet: "fd00::/120"}, "fd00::ff", "broadcast address"},
+		{"v6 default gateway", Range{Subnet: "fd00::/120"}, "fd00::1", "gateway"},
+		{"v6 free ip", Range{Subnet: "fd00::/120"}, "fd00::2", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			reason := c.r.reservedReason(normalizeIp(net.ParseIP(c.ip)))
+			if c.reason == "" {
+				if reason != "" {
+					t.Fatalf("reservedReason(%s) = %q, want empty", c.ip, reason)
+				}
+				return
+			}
+			if !strings.Contains(reason, c.reason) {
+				t.Fatalf("reservedReason(%s) = %q, want %q", c.ip, reason, c.reason)
+			}
+		})
+	}
+}
+
+func TestGetUnusedIp(t *testing.T) {
+	cases := []struct {
+		name         string
+		r            Range
+		lastReserved string
+		used         []string
+		want         string
+	}{
+		{"empty store skips gateway", Range{Subnet: "10.244.1.0/29"}, "", nil, "10.244.1.2"},
+		{"after last reserved", Range{Subnet: "10.244.1.0/29"}, "10.244.1.3", nil, "10.244.1.4"},
+		{"skip used ip", Range{Subnet: "10.244.1.0/29"}, "10.244.1.3", []string{"10.244.1.4"}, "10.244.1.5"},
+		{"wrap after last ip", Range{Subnet: "10.244.1.0/29"}, "10.244.1.6", nil, "10.244.1.2"},
+		{"wrap over used ips", Range{Subnet: "10.244.1.0/29"}, "10.244.1.5", []string{"10.244.1.6", "10.244.1.2"}, "10.244.1.3"},
+		{"released ip before last reserved", Range{Subnet: "10.244.1.0/29"}, "10.244.1.4", []string{"10.244.1.5", "10.244.1.6", "10.244.1.3"}, "10.244.1.2"},
+		{"full", Range{Subnet: "10.244.1.0/29"}, "10.244.1.4", []string{"10.244.1.2", "10.244.1.3", "10.244.1.4", "10.244.1.5", "10.244.1.6"}, ""},
+		{"last reserved out of range", Range{Subnet: "10.244.1.0/29", RangeStart: "10.244.1.4"}, "10.244.1.2", nil, "10.244.1.4"},
+		{"last reserved in other subnet", Range{Subnet: "10.244.1.0/29"}, "10.244.2.3", nil, "10.244.1.2"},
+		{"range start at network address", Range{Subnet: "10.244.1.0/29", RangeStart: "10.244.1.0"}, "", nil, "10.244.1.2"},
+		{"range end at broadcast address wraps", Range{Subnet: "10.244.1.0/29", RangeEnd: "10.244.1.7"}, "10.244.1.6", nil, "10.244.1.2"},
+		{"gateway override frees first ip", Range{Subnet: "10.244.1.0/29", Gateway: "10.244.1.6"}, "10.244.1.5", nil, "10.244.1.1"},
+		{"excluded ips skipped", Range{Subnet: "10.244.1.0/29", Exclude: []string{"10.244.1.2/31"}}, "", nil, "10.244.1.4"},
+		{"everything excluded", Range{Subnet: "10.244.1.0/29", Exclude: []string{"10.244.1.0/29"}}, "", nil, ""},
+		{"single ip range", Range{Subnet: "10.244.1.0/29", RangeStart: "10.244.1.5", RangeEnd: "10.244.1.5"}, "10.244.1.5", nil, "10.244.1.5"},
+		{"v6", Range{Subnet: "fd00::/125"}, "", nil, "fd00::2"},
+		{"v6 wrap", Range{Subnet: "fd00::/125"}, "fd00::6", []string{"fd00::2"}, "fd00::3"},
+		{"exclude up to range end wraps", Range{Subnet: "10.244.1.0/29", Exclude: []string{"10.244.1.4/30"}}, "10.244.1.3", nil, "10.244.1.2"},
+		{"start in exclude", Range{Subnet: "10.244.1.0/28", Exclude: []string{"10.244.1.4/30"}}, "10.244.1.5", nil, "10.244.1.8"},
+		{"start in exclude wraps", Range{Subnet: "10.244.1.0/28", Exclude: []string{"10.244.1.4/30"}}, "10.244.1.5", []string{"10.244.1.8", "10.244.1.9", "10.244.1.10", "10.244.1.11", "10.244.1.12", "10.244.1.13", "10.244.1.14"}, "10.244.1.2"},
+		{"full with start in exclude", Range{Subnet: "10.244.1.0/28", Exclude: []string{"10.244.1.4/30"}}, "10.244.1.5", []string{"10.244.1.2", "10.244.1.3", "10.244.1.8", "10.244.1.9", "10.244.1.10", "10.244.1.11", "10.244.1.12", "10.244.1.13", "10.244.1.14"}, ""},
+		{"v6 /64 large exclude", Range{Subnet: "fd00:10:244:1::/64", Exclude: []string{"fd00:10:244:1::/65"}}, "", nil, "fd00:10:244:1:8000::"},
+		{"v6 /64 large exclude wraps", Range{Subnet: "fd00:10:244:1::/64", Exclude: []string{"fd00:10:244:1:8000::/65"}}, "fd00:10:244:1:7fff:ffff:ffff:ffff", nil, "fd00:10:244:1::2"},
+		{"v6 /64 nested excludes", Range{Subnet: "fd00:10:244:1::/64", Exclude: []string{"fd00:10:244:1::/66", "fd00:10:244:1::/65", "fd00:10:244:1:8000::/120"}}, "", nil, "fd00:10:244:1:8000::100"},
+		{"v6 /64 all excluded", Range{Subnet: "fd00:10:244:1::/64", Exclude: []string{"fd00:10:244:1::/65", "fd00:10:244:1:8000::/65"}}, "fd00:10:244:1::1234", nil, ""},
+		{"v6 /64 excluded whole subnet", Range{Subnet: "fd00:10:244:1::/64", Exclude: []string{"fd00:10:244:1::/64"}}, "", nil, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			useTempStorage(t)
+			if c.lastReserved != "" {
+				if err := setLastReserved(c.r.Subnet, net.ParseIP(c.lastReserved)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			reserveIps(t, c.used...)
+			got := getUnusedIp(&c.r, 0)
+			if c.want == "" {
+				if got != nil {
+					t.Fatalf("getUnusedIp() = %s, want nil", got)
+				}
+				return
+			}
+			if got == nil || got.IP.String() != c.want {
+				t.Fatalf("getUnusedIp() = %v, want %s", got, c.want)
+			}
+			if got.Mask.String() != CidrToIpNet(c.r.Subnet).Mask.String() {
+				t.Fatalf("getUnusedIp() mask = %s, want mask of %s", got.Mask, c.r.Subnet)
+			}
+		})
+	}
+}
+
+func TestGetUnusedIpQuarantine(t *testing.T) {
+	useTempStorage(t)
+	r := &Range{Subnet: "10.244.1.0/29"}
+	//.2到.6中只有.5、.6是空闲的，.5刚释放
+	reserveIps(t, "10.244.1.2", "10.244.1.3", "10.244.1.4")
+	markReleased("10.244.1.5")
+	if got := getUnusedIp(r, time.Hour); got == nil || got.IP.String() != "10.244.1.6" {
+		t.Fatalf("getUnusedIp() = %v, want 10.244.1.6", got)
+	}
+	if got := getUnusedIp(r, 0); got == nil || got.IP.String() != "10.244.1.5" {
+		t.Fatalf("getUnusedIp() without quarantine = %v, want 10.244.1.5", got)
+	}
+
+	//空闲的ip都在quarantine中时使用释放最早的
+	markReleased("10.244.1.6")
+	old := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(ReleasedStoragePath+"/10.244.1.6", old, old); err != nil {
+		t.Fatal(err)
+	}
+	if got := getUnusedIp(r, time.Hour); got == nil || got.IP.String() != "10.244.1.6" {
+		t.Fatalf("getUnusedIp() all in quarantine = %v, want 10.244.1.6", got)
+	}
+	//过了quarantine的ip可以正常分配
+	if got := getUnusedIp(r, 30*time.Second); got == nil || got.IP.String() != "10.244.1.6" {
+		t.Fatalf("getUnusedIp() after quarantine = %v, want 10.244.1.6", got)
+	}
+}
@@ -0,0 +1,123 @@
+package ipam
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"test-cni/utils"
+	"time"
+)
+
+// LastReservedStoragePath 每个子网上一次自动分配的ip，下一次从它后面接着分配，类似host-local的last_reserved_ip
+var LastReservedStoragePath = ipStorageBasePath + "/last_reserved"
+
+// ReleasedStoragePath 记录ip被释放的时间（文件的修改时间），quarantine期间不会再自动分配
+var ReleasedStoragePath = ipStorageBasePath + "/released"
+
+func lastReservedFile(cidr string) string {
+	return fmt.Sprintf("%s/%s", LastReservedStoragePath, strings.ReplaceAll(cidr, "/", "_"))
+}
+
+func getLastReserved(cidr string) net.IP {
+	b, err := os.ReadFile(lastReservedFile(cidr))
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(b)))
+	if ip == nil {
+		return nil
+	}
+	return normalizeIp(ip)
+}
+
+func setLastReserved(cidr string, ip net.IP) error {
+	if err := os.MkdirAll(LastReservedStoragePath, 0766); err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(lastReservedFile(cidr), []byte(ip.String()), 0766)
+}
+
+// markReleased 记下ip的释放时间，写失败只会让ip提前被复用，不影响释放
+func markReleased(ip string) {
+	if err := os.MkdirAll(ReleasedStoragePath, 0766); err != nil {
+		return
+	}
+	_ = utils.WriteFileAtomic(fmt.Sprintf("%s/%s", ReleasedStoragePath, ip), nil, 0766)
+}
+
+// releasedAt 返回ip上一次被释放的时间，没有记录时返回零值
+func releasedAt(ip string) time.Time {
+	info, err := os.Stat(fmt.Sprintf("%s/%s", ReleasedStoragePath, ip))
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func clearReleased(ip string) {
+	_ = utils.DeleteFile(fmt.Sprintf("%s/%s", ReleasedStoragePath, ip))
+}
+
+// getUnusedIp 从上一次分配的ip后面开始找空闲ip，到范围末尾后回到开头，避免刚释放的ip马上被下一个pod拿到
+// 释放时间不到quarantine的ip先跳过，所有空闲ip都在quarantine中时使用释放最早的那个，不让pod因此起不来
+// 调用方持有节点的锁，排除的网段整段跳过，ipv6的大网段也不会逐个ip检查
+func getUnusedIp(r *Range, quarantine time.Duration) *net.IPNet {
+	ipNet := CidrToIpNet(r.Subnet)
+	if ipNet == nil {
+		return nil
+	}
+	first, last := r.bounds()
+	if !ipNet.Contains(first) || !ipNet.Contains(last) || ipBefore(last, first) {
+		return nil
+	}
+
+	start := first
+	if lastReserved := getLastReserved(r.Subnet); lastReserved != nil && ipBefore(lastReserved, last) && !ipBefore(lastReserved, first) {
+		start = nextIP(lastReserved)
+	}
+
+	var oldest net.IP
+	var oldestReleased time.Time
+	ip := start
+	//从start找到last，再从first找到start之前，跳过排除的网段时可能越过start，不能只判断相等
+	wrapped := false
+	for !wrapped || ipBefore(ip, start) {
+		end := r.excludeEnd(ip)
+		if end == nil {
+			if r.reservedReason(ip) == "" && !utils.FileIsExisted(fmt.Sprintf("%s/%s", IpStoragePath, ip.String())) {
+				released := releasedAt(ip.String())
+				if quarantine <= 0 || released.IsZero() || time.Since(released) >= quarantine {
+					return &net.IPNet{IP: ip, Mask: ipNet.Mask}
+				}
+				if oldest == nil || released.Before(oldestReleased) {
+					oldest, oldestReleased = ip, released
+				}
+			}
+			end = ip
+		}
+		//排除的网段整段跳过，到了范围末尾时回到开头
+		if ipBefore(end, last) {
+			ip = nextIP(end)
+		} else if !wrapped {
+			wrapped = true
+			ip = first
+		} else {
+			break
+		}
+	}
+	if oldest != nil {
+		return &net.IPNet{IP: oldest, Mask: ipNet.Mask}
+	}
+	return nil
+}
+
+func ipBefore(a, b net.IP) bool {
+	a16, b16 := a.To16(), b.To16()
+	for i := range a16 {
+		if a16[i] != b16[i] {
+			return a16[i] < b16[i]
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package ipam
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"test-cni/utils"
+	"time"
+)
+
+// AttachmentStoragePath 每个容器网卡一个json记录，文件名由容器id和网卡名组成
+var AttachmentStoragePath = ipStorageBasePath + "/attachments"
+
+// ContainerIdStoragePath 旧版本按容器id记录ip的目录，只在迁移时读取
+var ContainerIdStoragePath = ipStorageBasePath + "/container_ids"
+
+// InitStorage 插件启动时创建ip存储的目录，test-cni和testcni-ipam共用
+func InitStorage() {
+	for _, dir := range []string{IpStoragePath, AttachmentStoragePath} {
+		if !utils.PathExists(dir) {
+			_ = utils.CreateDir(dir)
+		}
+	}
+}
+
+// legacyIfName 旧版本的记录里没有网卡名时使用kubelet默认的网卡名
+const legacyIfName = "eth0"
+
+// AttachmentIp 分配给容器网卡的一个地址
+type AttachmentIp struct {
+	//带掩码的地址，比如10.244.1.5/24，旧版本迁移过来的记录没有掩码
+	Address string `json:"address"`
+	Gateway string `json:"gateway,omitempty"`
+	//分配这个地址的子网
+	Subnet string `json:"subnet,omitempty"`
+}
+
+// Attachment 一个容器网卡的ip分配记录，容器id和网卡名一起作为key，同一个容器的多张网卡互不影响
+type Attachment struct {
+	ContainerId  string         `json:"containerId"`
+	IfName       string         `json:"ifName"`
+	Network      string         `json:"network,omitempty"`
+	Netns        string         `json:"netns,omitempty"`
+	PodNamespace string         `json:"podNamespace,omitempty"`
+	PodName      string         `json:"podName,omitempty"`
+	Ips          []AttachmentIp `json:"ips"`
+	CreatedAt    time.Time      `json:"createdAt"`
+}
+
+// IpStrs 返回不带掩码的ip
+func (a *Attachment) IpStrs() []string {
+	var ips []string
+	for _, ip := range a.Ips {
+		if addr, _, err := net.ParseCIDR(ip.Address); err == nil {
+			ips = append(ips, addr.String())
+		} else {
+			ips = append(ips, ip.Address)
+		}
+	}
+	return ips
+}
+
+// attachmentKey 容器id和网卡名中都不允许出现冒号，拼起来不会有歧义
+func attachmentKey(containerId, ifName string) string {
+	return containerId + ":" + ifName
+}
+
+func attachmentFile(key string) string {
+	return fmt.Sprintf("%s/%s.json", AttachmentStoragePath, key)
+}
+
+// GetAttachment 读取容器网卡的记录，不存在时返回的错误满足os.IsNotExist
+func GetAttachment(containerId, ifName string) (*Attachment, error) {
+	return readAttachment(attachmentFile(attachmentKey(containerId, ifName)))
+}
+
+func readAttachment(path string) (*Attachment, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	att := &Attachment{}
+	if err = json.Unmarshal(b, att); err != nil {
+		return nil, fmt.Errorf("unmarshal attachment %s error:%s", path, err.Error())
+	}
+	return att, nil
+}
+
+func writeAttachment(att *Attachment) error {
+	b, err := json.MarshalIndent(att, "", "    ")
+	if err != nil {
+		return fmt.Errorf("marshal attachment error:%s", err.Error())
+	}
+	path := attachmentFile(attachmentKey(att.ContainerId, att.IfName))
+	if err = utils.WriteFileAtomic(path, b, 0766); err != nil {
+		return fmt.Errorf("write attachment file %s error:%s", path, err.Error())
+	}
+	return nil
+}
+
+// ListAttachments 列出所有attachment记录，读不出来的记录会被跳过
+func ListAttachments() ([]*Attachment, error) {
+	entries, err := os.ReadDir(AttachmentStoragePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var res []*Attachment
+	for _, e := range entries {
+		//跳过WriteFileAtomic留下的临时文件
+		if strings.HasPrefix(e.Name(), ".") || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		att, err := readAttachment(fmt.Sprintf("%s/%s", AttachmentStoragePath, e.Name()))
+		if err != nil {
+			continue
+		}
+		res = append(res, att)
+	}
+	return res, nil
+}
+
+// Migrate 把旧版本container_ids/<id>加ips/<ip>的存储转换成attachment记录，调用方需要持有锁
+// 每迁移完一个容器就删掉它的旧记录，中途失败下次可以接着迁移
+func Migrate() error {
+	entries, err := os.ReadDir(ContainerIdStoragePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, e := range entries {
+		containerIdFile := fmt.Sprintf("%s/%s", ContainerIdStoragePath, e.Name())
+		if strings.HasPrefix(e.Name(), ".") {
+			_ = utils.DeleteFile(containerIdFile)
+			continue
+		}
+		if err = migrateContainer(e); err != nil {
+			return fmt.Errorf("migrate container %s error:%s", e.Name(), err.Error())
+		}
+	}
+	//目录非空说明还有没迁移完的，留到下次
+	_ = os.Remove(ContainerIdStoragePath)
+	return nil
+}
+
+func migrateContainer(e os.DirEntry) error {
+	containerId := e.Name()
+	containerIdFile := fmt.Sprintf("%s/%s", ContainerIdStoragePath, containerId)
+	info, err := e.Info()
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(containerIdFile)
+	if err != nil {
+		return err
+	}
+	ips := splitIps(string(b))
+
+	//较新的旧版本在ip文件里记录了"容器id\n网卡名"，更早的版本ip文件是空的
+	att := &Attachment{ContainerId: containerId, IfName: legacyIfName, CreatedAt: info.ModTime()}
+	for _, ip := range ips {
+		content, err := os.ReadFile(fmt.Sprintf("%s/%s", IpStoragePath, ip))
+		if err != nil {
+			continue
+		}
+		if lines := splitIps(string(content)); len(lines) == 2 && lines[0] == containerId {
+			att.IfName = lines[1]
+		}
+	}
+	for _, ip := range ips {
+		att.Ips = append(att.Ips, AttachmentIp{Address: ip})
+	}
+
+	if err = writeAttachment(att); err != nil {
+		return err
+	}
+	key := attachmentKey(att.ContainerId, att.IfName)
+	for _, ip := range ips {
+		if err = utils.WriteFileAtomic(fmt.Sprintf("%s/%s", IpStoragePath, ip), []byte(key), 0766); err != nil {
+			return err
+		}
+	}
+	return utils.DeleteFile(containerIdFile)
+}
@@ -12,38 +12,112 @@ import (
 )
 
 func main() {
-	if !utils.PathExists(ipam.IpStoragePath) {
-		_ = utils.CreateDir(ipam.IpStoragePath)
-	}
-	if !utils.PathExists(ipam.ContainerIdStoragePath) {
-		_ = utils.CreateDir(ipam.ContainerIdStoragePath)
-	}
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("testcni"))
+	ipam.InitStorage()
+	skel.PluginMainFuncs(skel.CNIFuncs{
+		Add:    cmdAdd,
+		Del:    cmdDel,
+		Check:  cmdCheck,
+		GC:     cmdGC,
+		Status: cmdStatus,
+	}, version.All, bv.BuildString("testcni"))
 }
 
 func cmdAdd(args *skel.CmdArgs) error {
+	plugin.SetLogFields("ADD", args)
 	pluginConfig := plugin.GetConfigs(args)
 	if pluginConfig == nil {
 		errMsg := fmt.Errorf("add: get plugin config error, config: %s", string(args.StdinData))
-		utils.WriteLog(errMsg.Error())
+		utils.LogError(errMsg.Error())
 		return errMsg
 	}
+	utils.InitLog(pluginConfig.Log)
+	pluginConfig.SetPodLogFields()
 
 	res, err := plugin.Bootstrap(args, pluginConfig, args.ContainerID)
 	if err != nil {
-		utils.WriteLog("Bootstrap error: ", err.Error())
+		utils.LogError("Bootstrap error", "error", err.Error())
 		return err
 	}
 
+	utils.LogInfo("add ok", "ips", res.IPs)
 	_ = cniTypes.PrintResult(res, pluginConfig.CNIVersion)
 	return nil
 }
 
 func cmdDel(args *skel.CmdArgs) error {
-	ipam.ReleaseIp(args.ContainerID)
+	plugin.SetLogFields("DEL", args)
+	pluginConfig := plugin.GetConfigs(args)
+	if pluginConfig == nil {
+		//配置有问题时也要释放ip，只是不拆设备
+		utils.LogWarn("del: get plugin config error, only release ips", "config", string(args.StdinData))
+		if err := plugin.ReleaseWithoutConfig(args); err != nil {
+			utils.LogError("ReleaseWithoutConfig error", "error", err.Error())
+			return err
+		}
+		return nil
+	}
+	utils.InitLog(pluginConfig.Log)
+	pluginConfig.SetPodLogFields()
+
+	err := plugin.Teardown(args, pluginConfig)
+	if err != nil {
+		utils.LogError("Teardown error", "error", err.Error())
+		return err
+	}
 	return nil
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
+	plugin.SetLogFields("CHECK", args)
+	pluginConfig := plugin.GetConfigs(args)
+	if pluginConfig == nil {
+		errMsg := fmt.Errorf("check: get plugin config error, config: %s", string(args.StdinData))
+		utils.LogError(errMsg.Error())
+		return errMsg
+	}
+	utils.InitLog(pluginConfig.Log)
+	pluginConfig.SetPodLogFields()
+
+	err := plugin.Check(args, pluginConfig)
+	if err != nil {
+		utils.LogError("Check error", "error", err.Error())
+		return err
+	}
+	return nil
+}
+
+func cmdGC(args *skel.CmdArgs) error {
+	plugin.SetLogFields("GC", args)
+	pluginConfig := plugin.GetConfigs(args)
+	if pluginConfig == nil {
+		errMsg := fmt.Errorf("gc: get plugin config error, config: %s", string(args.StdinData))
+		utils.LogError(errMsg.Error())
+		return errMsg
+	}
+	utils.InitLog(pluginConfig.Log)
+
+	err := plugin.GC(args, pluginConfig)
+	if err != nil {
+		utils.LogError("GC error", "error", err.Error())
+		return err
+	}
+	return nil
+}
+
+func cmdStatus(args *skel.CmdArgs) error {
+	plugin.SetLogFields("STATUS", args)
+	pluginConfig := plugin.GetConfigs(args)
+	if pluginConfig == nil {
+		errMsg := fmt.Errorf("status: get plugin config error, config: %s", string(args.StdinData))
+		utils.LogError(errMsg.Error())
+		return errMsg
+	}
+	utils.InitLog(pluginConfig.Log)
+
+	err := plugin.Status(args, pluginConfig)
+	if err != nil {
+		utils.LogError("Status error", "error", err.Error())
+		return err
+	}
 	return nil
 }
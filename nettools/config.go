@@ -0,0 +1,125 @@
+package nettools
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// vxlan封装的额外开销：外层ip头+udp头+vxlan头+内层以太网头
+const (
+	VxlanOverheadIPv4 = 50
+	VxlanOverheadIPv6 = 70
+)
+
+const (
+	DefaultMTU         = 1450
+	DefaultBridgeName  = "testcni0"
+	DefaultVxlanDevice = "testcni.1"
+	DefaultVNI         = 1
+	DefaultVxlanPort   = 8472
+)
+
+// PortRange vxlan封装时udp源端口的范围，0表示使用内核默认值
+type PortRange struct {
+	Low  int `json:"low"`
+	High int `json:"high"`
+}
+
+// ParsePortRange 解析"low-high"格式的端口范围
+func ParsePortRange(s string) (PortRange, error) {
+	if s == "" {
+		return PortRange{}, nil
+	}
+	arr := strings.Split(s, "-")
+	if len(arr) != 2 {
+		return PortRange{}, &InvalidArgError{Name: "port range", Value: s}
+	}
+	low, err := strconv.Atoi(strings.TrimSpace(arr[0]))
+	if err != nil {
+		return PortRange{}, &InvalidArgError{Name: "port range", Value: s}
+	}
+	high, err := strconv.Atoi(strings.TrimSpace(arr[1]))
+	if err != nil {
+		return PortRange{}, &InvalidArgError{Name: "port range", Value: s}
+	}
+	return PortRange{Low: low, High: high}, nil
+}
+
+// OverlayMTU 根据底层网卡的mtu和地址族算出vxlan、网桥和pod网卡应该使用的mtu
+func OverlayMTU(underlayMTU int, underlayIp net.IP) int {
+	if underlayIp.To4() == nil {
+		return underlayMTU - VxlanOverheadIPv6
+	}
+	return underlayMTU - VxlanOverheadIPv4
+}
+
+// DeviceConfig 插件和daemonset共用的设备配置，两边必须一致
+type DeviceConfig struct {
+	MTU         int    `json:"mtu"`
+	Bridge      string `json:"bridge"`
+	VxlanDevice string `json:"vxlanDevice"`
+	//指针区分没有配置和显式配置的0，0不是合法的vni
+	VNI          *int      `json:"vni,omitempty"`
+	VxlanPort    int       `json:"vxlanPort"`
+	VxlanSrcPort PortRange `json:"vxlanSrcPort"`
+}
+
+// SetDefaults 没有配置的字段使用默认值
+func (c *DeviceConfig) SetDefaults() {
+	if c.MTU == 0 {
+		c.MTU = DefaultMTU
+	}
+	if c.Bridge == "" {
+		c.Bridge = DefaultBridgeName
+	}
+	if c.VxlanDevice == "" {
+		c.VxlanDevice = DefaultVxlanDevice
+	}
+	if c.VNI == nil {
+		vni := DefaultVNI
+		c.VNI = &vni
+	}
+	if c.VxlanPort == 0 {
+		c.VxlanPort = DefaultVxlanPort
+	}
+}
+
+// GetVNI 没有配置时返回默认值
+func (c *DeviceConfig) GetVNI() int {
+	if c.VNI == nil {
+		return DefaultVNI
+	}
+	return *c.VNI
+}
+
+func (c *DeviceConfig) Validate() error {
+	//ipv4要求链路mtu至少576
+	if c.MTU < 576 || c.MTU > 65535 {
+		return fmt.Errorf("mtu %d out of range [576, 65535]", c.MTU)
+	}
+	if len(c.Bridge) > 15 {
+		return fmt.Errorf("bridge name %s longer than 15", c.Bridge)
+	}
+	if len(c.VxlanDevice) > 15 {
+		return fmt.Errorf("vxlan device name %s longer than 15", c.VxlanDevice)
+	}
+	if c.Bridge == c.VxlanDevice {
+		return fmt.Errorf("bridge and vxlan device can not both be %s", c.Bridge)
+	}
+	//vni是24位的，0不能使用
+	if vni := c.GetVNI(); vni < 1 || vni > 1<<24-1 {
+		return fmt.Errorf("vni %d out of range [1, %d]", vni, 1<<24-1)
+	}
+	if c.VxlanPort <= 0 || c.VxlanPort > 65535 {
+		return fmt.Errorf("vxlan port %d out of range [1, 65535]", c.VxlanPort)
+	}
+	r := c.VxlanSrcPort
+	if r.Low != 0 || r.High != 0 {
+		if r.Low <= 0 || r.High > 65535 || r.Low > r.High {
+			return fmt.Errorf("vxlan src port range %d-%d invalid", r.Low, r.High)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package nettools
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDeviceConfigVNI(t *testing.T) {
+	cases := []struct {
+		conf string
+		vni  int
+		err  string
+	}{
+		{`{}`, DefaultVNI, ""},
+		{`{"vni":42}`, 42, ""},
+		{`{"vni":16777215}`, 1<<24 - 1, ""},
+		{`{"vni":0}`, 0, "vni 0 out of range"},
+		{`{"vni":16777216}`, 0, "out of range"},
+		{`{"vni":-1}`, 0, "out of range"},
+	}
+	for _, c := range cases {
+		conf := &DeviceConfig{}
+		if err := json.Unmarshal([]byte(c.conf), conf); err != nil {
+			t.Fatal(err)
+		}
+		conf.SetDefaults()
+		err := conf.Validate()
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("Validate(%s) error = %v, want %q", c.conf, err, c.err)
+			}
+			continue
+		}
+		if err != nil || conf.GetVNI() != c.vni {
+			t.Errorf("Validate(%s) = %d, %v, want %d", c.conf, conf.GetVNI(), err, c.vni)
+		}
+	}
+}
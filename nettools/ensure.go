@@ -0,0 +1,193 @@
+package nettools
+
+import (
+	"fmt"
+	"github.com/vishvananda/netlink"
+	"net"
+)
+
+// Ensure*系列函数比较设备的期望状态和实际状态，就地修正不一致的地方，
+// 返回对设备做过的每一处修改，设备已经符合期望时返回空
+
+// vxlanMismatch 比较已有的vxlan设备和期望的参数，返回不一致的地方，一致时返回空字符串
+// 这些参数不能就地修改，只能删掉重建
+func vxlanMismatch(vxlan *netlink.Vxlan, opts *VxlanOptions) string {
+	switch {
+	case vxlan.VxlanId != opts.VNI:
+		return fmt.Sprintf("vni %d != %d", vxlan.VxlanId, opts.VNI)
+	case vxlan.Port != opts.Port:
+		return fmt.Sprintf("port %d != %d", vxlan.Port, opts.Port)
+	case opts.PortLow != 0 && (vxlan.PortLow != opts.PortLow || vxlan.PortHigh != opts.PortHigh):
+		return fmt.Sprintf("src port %d-%d != %d-%d", vxlan.PortLow, vxlan.PortHigh, opts.PortLow, opts.PortHigh)
+	case vxlan.VtepDevIndex != opts.VtepDevIndex:
+		return fmt.Sprintf("vtep dev index %d != %d", vxlan.VtepDevIndex, opts.VtepDevIndex)
+	case opts.SrcAddr != nil && !vxlan.SrcAddr.Equal(opts.SrcAddr):
+		return fmt.Sprintf("src addr %s != %s", vxlan.SrcAddr, opts.SrcAddr)
+	case vxlan.Learning:
+		return "learning enabled"
+	}
+	return ""
+}
+
+func EnsureVxlan(opts *VxlanOptions, addrs ...*net.IPNet) (*netlink.Vxlan, []string, error) {
+	var changes []string
+	name := opts.Name
+	l, err := netlink.LinkByName(name)
+	if err != nil && !IsLinkNotFound(err) {
+		return nil, nil, fmt.Errorf("get vxlan by name:%s error:%s", name, err.Error())
+	}
+	if l != nil {
+		vxlan, ok := l.(*netlink.Vxlan)
+		if !ok {
+			return nil, nil, fmt.Errorf("found the device %s but it's not a vxlan", name)
+		}
+		//参数不一致的设备不能直接复用，删掉重建
+		if mismatch := vxlanMismatch(vxlan, opts); mismatch != "" {
+			if err = netlink.LinkDel(vxlan); err != nil {
+				return nil, nil, fmt.Errorf("delete vxlan:%s error:%s", name, err.Error())
+			}
+			changes = append(changes, fmt.Sprintf("delete vxlan %s: %s", name, mismatch))
+			l = nil
+		}
+	}
+
+	if l == nil {
+		err = netlink.LinkAdd(&netlink.Vxlan{
+			VxlanId: opts.VNI,
+			LinkAttrs: netlink.LinkAttrs{
+				Name: name,
+				MTU:  opts.MTU,
+			},
+			Port:         opts.Port,
+			PortLow:      opts.PortLow,
+			PortHigh:     opts.PortHigh,
+			VtepDevIndex: opts.VtepDevIndex,
+			SrcAddr:      opts.SrcAddr,
+			//fdb由daemonset根据节点注解写入，不需要内核学习
+			Learning: false,
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("create vxlan:%s error:%s", name, err.Error())
+		}
+		changes = append(changes, fmt.Sprintf("create vxlan %s", name))
+
+		l, err = netlink.LinkByName(name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("get vxlan by name:%s error:%s", name, err.Error())
+		}
+	}
+
+	vxlan, ok := l.(*netlink.Vxlan)
+	if !ok {
+		return nil, nil, fmt.Errorf("found the device %s but it's not a vxlan", name)
+	}
+
+	//vxlan设备上的地址都是主机地址
+	var hostAddrs []*net.IPNet
+	for _, addr := range addrs {
+		ipLen := len(addr.IP.To16()) * 8
+		if addr.IP.To4() != nil {
+			ipLen = net.IPv4len * 8
+		}
+		hostAddrs = append(hostAddrs, &net.IPNet{IP: addr.IP, Mask: net.CIDRMask(ipLen, ipLen)})
+	}
+	linkChanges, err := ensureLinkState(vxlan, opts.MTU, hostAddrs)
+	changes = append(changes, linkChanges...)
+	if err != nil {
+		return nil, changes, err
+	}
+	return vxlan, changes, nil
+}
+
+func EnsureBridge(brName string, gws []*net.IPNet, mtu int) (*netlink.Bridge, []string, error) {
+	var changes []string
+	l, err := netlink.LinkByName(brName)
+	if err != nil && !IsLinkNotFound(err) {
+		return nil, nil, fmt.Errorf("found bridge first by name:%s error:%s", brName, err.Error())
+	}
+
+	if l == nil {
+		err = netlink.LinkAdd(&netlink.Bridge{
+			LinkAttrs: netlink.LinkAttrs{
+				Name:   brName,
+				MTU:    mtu,
+				TxQLen: -1,
+			},
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("can not create bridge:%s, err:%s", brName, err.Error())
+		}
+		changes = append(changes, fmt.Sprintf("create bridge %s", brName))
+
+		//这里需要通过netlink重新获取网桥，否则光创建的话无法从上头拿到其他属性
+		l, err = netlink.LinkByName(brName)
+		if err != nil {
+			return nil, nil, fmt.Errorf("found bridge second by name:%s error:%s", brName, err.Error())
+		}
+	}
+
+	br, ok := l.(*netlink.Bridge)
+	if !ok {
+		return nil, nil, fmt.Errorf("found the device %s but it's not a bridge device", brName)
+	}
+
+	linkChanges, err := ensureLinkState(br, mtu, gws)
+	changes = append(changes, linkChanges...)
+	if err != nil {
+		return nil, changes, err
+	}
+	return br, changes, nil
+}
+
+// ensureLinkState 修正设备的mtu、地址和up状态，多余的地址会被删掉，ipv6链路本地地址除外
+func ensureLinkState(link netlink.Link, mtu int, addrs []*net.IPNet) ([]string, error) {
+	var changes []string
+	name := link.Attrs().Name
+
+	if link.Attrs().MTU != mtu {
+		if err := netlink.LinkSetMTU(link, mtu); err != nil {
+			return changes, fmt.Errorf("set mtu of %s to %d error:%s", name, mtu, err.Error())
+		}
+		changes = append(changes, fmt.Sprintf("set %s mtu %d -> %d", name, link.Attrs().MTU, mtu))
+	}
+
+	existing, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return changes, fmt.Errorf("list addr of %s error:%s", name, err.Error())
+	}
+	desired := make(map[string]bool)
+	for _, addr := range addrs {
+		desired[addr.String()] = true
+	}
+	present := make(map[string]bool)
+	for _, a := range existing {
+		if desired[a.IPNet.String()] {
+			present[a.IPNet.String()] = true
+			continue
+		}
+		if a.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if err = netlink.AddrDel(link, &a); err != nil {
+			return changes, fmt.Errorf("delete addr %s from %s error:%s", a.IPNet, name, err.Error())
+		}
+		changes = append(changes, fmt.Sprintf("delete addr %s from %s", a.IPNet, name))
+	}
+	for _, addr := range addrs {
+		if present[addr.String()] {
+			continue
+		}
+		if err = netlink.AddrAdd(link, newAddr(addr)); err != nil {
+			return changes, fmt.Errorf("can not add the ip %v to %s, err: %s", addr, name, err.Error())
+		}
+		changes = append(changes, fmt.Sprintf("add addr %s to %s", addr, name))
+	}
+
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		if err = netlink.LinkSetUp(link); err != nil {
+			return changes, fmt.Errorf("set up %s error:%s", name, err.Error())
+		}
+		changes = append(changes, fmt.Sprintf("set %s up", name))
+	}
+	return changes, nil
+}
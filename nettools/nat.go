@@ -0,0 +1,162 @@
+package nettools
+
+import (
+	"fmt"
+	"github.com/coreos/go-iptables/iptables"
+	"net"
+)
+
+// Iptables 是对iptables/ip6tables的最小抽象，*iptables.IPTables实现了这个接口
+type Iptables interface {
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	Append(table, chain string, rulespec ...string) error
+	AppendUnique(table, chain string, rulespec ...string) error
+	DeleteIfExists(table, chain string, rulespec ...string) error
+	ClearChain(table, chain string) error
+}
+
+// NewIptables 根据地址族返回iptables或ip6tables，可以替换成其他实现
+var NewIptables = func(ipv6 bool) (Iptables, error) {
+	proto := iptables.ProtocolIPv4
+	if ipv6 {
+		proto = iptables.ProtocolIPv6
+	}
+	return iptables.NewWithProtocol(proto)
+}
+
+// NatError iptables规则操作失败
+type NatError struct {
+	Op   string
+	Rule []string
+	Err  error
+}
+
+func (e *NatError) Error() string {
+	return fmt.Sprintf("%s nat rule %v error:%s", e.Op, e.Rule, e.Err.Error())
+}
+
+func (e *NatError) Unwrap() error {
+	return e.Err
+}
+
+func snatRule(podCidr, hostIp, dev string) (bool, []string, error) {
+	_, ipNet, err := net.ParseCIDR(podCidr)
+	if err != nil {
+		return false, nil, &InvalidArgError{Name: "pod cidr", Value: podCidr}
+	}
+	isV6 := ipNet.IP.To4() == nil
+	rule := []string{"-s", ipNet.String(), "-o", dev}
+	//宿主机ip和pod网段不是同一个地址族时（比如ipv4的节点上跑ipv6的pod）只能用MASQUERADE
+	h := net.ParseIP(hostIp)
+	if h == nil || (h.To4() == nil) != isV6 {
+		rule = append(rule, "-j", "MASQUERADE")
+	} else {
+		rule = append(rule, "-j", "SNAT", "--to-source", h.String())
+	}
+	return isV6, rule, nil
+}
+
+// DelSNat 删除旧版本直接加在POSTROUTING上的snat规则，规则不存在时返回nil
+func DelSNat(podCidr, hostIp, dev string) error {
+	isV6, rule, err := snatRule(podCidr, hostIp, dev)
+	if err != nil {
+		return err
+	}
+	ipt, err := NewIptables(isV6)
+	if err != nil {
+		return &NatError{Op: "init", Rule: rule, Err: err}
+	}
+	if err = ipt.DeleteIfExists("nat", "POSTROUTING", rule...); err != nil {
+		return &NatError{Op: "delete", Rule: rule, Err: err}
+	}
+	return nil
+}
+
+// MasqChain 所有snat规则都放在这条链里，POSTROUTING只保留一条跳转规则
+const MasqChain = "TESTCNI-POSTROUTING"
+
+// MasqConfig 描述本节点pod出宿主机时的snat规则
+type MasqConfig struct {
+	//本节点的pod网段，作为snat的源地址
+	PodCidrs []string
+	//整个集群的pod网段，访问这些地址不做snat
+	ClusterCidrs []string
+	//额外不需要snat的目的网段
+	NonMasqueradeCidrs []string
+	HostIp             string
+	Dev                string
+	//节点ip会变化时使用MASQUERADE，否则使用固定源地址的SNAT
+	Masquerade bool
+}
+
+// SyncMasquerade 每次都清空并重建MasqChain，daemonset重启多少次规则都只有一份
+func SyncMasquerade(conf *MasqConfig) error {
+	for _, isV6 := range []bool{false, true} {
+		podCidrs, err := filterCidrs(conf.PodCidrs, isV6)
+		if err != nil {
+			return err
+		}
+		if len(podCidrs) == 0 {
+			continue
+		}
+		exempts, err := filterCidrs(append(append([]string{}, conf.ClusterCidrs...), conf.NonMasqueradeCidrs...), isV6)
+		if err != nil {
+			return err
+		}
+		if err = syncMasqueradeChain(conf, isV6, podCidrs, exempts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func syncMasqueradeChain(conf *MasqConfig, isV6 bool, podCidrs, exempts []string) error {
+	ipt, err := NewIptables(isV6)
+	if err != nil {
+		return &NatError{Op: "init", Err: err}
+	}
+	//链不存在时ClearChain会创建
+	if err = ipt.ClearChain("nat", MasqChain); err != nil {
+		return &NatError{Op: "clear chain", Rule: []string{MasqChain}, Err: err}
+	}
+	jump := []string{"-m", "comment", "--comment", "testcni masquerade", "-j", MasqChain}
+	if err = ipt.AppendUnique("nat", "POSTROUTING", jump...); err != nil {
+		return &NatError{Op: "append", Rule: jump, Err: err}
+	}
+
+	var rules [][]string
+	for _, cidr := range exempts {
+		rules = append(rules, []string{"-d", cidr, "-j", "RETURN"})
+	}
+	h := net.ParseIP(conf.HostIp)
+	for _, cidr := range podCidrs {
+		rule := []string{"-s", cidr, "-o", conf.Dev}
+		//宿主机ip和pod网段不是同一个地址族时（比如ipv4的节点上跑ipv6的pod）只能用MASQUERADE
+		if conf.Masquerade || h == nil || (h.To4() == nil) != isV6 {
+			rule = append(rule, "-j", "MASQUERADE")
+		} else {
+			rule = append(rule, "-j", "SNAT", "--to-source", h.String())
+		}
+		rules = append(rules, rule)
+	}
+	for _, rule := range rules {
+		if err = ipt.Append("nat", MasqChain, rule...); err != nil {
+			return &NatError{Op: "append", Rule: rule, Err: err}
+		}
+	}
+	return nil
+}
+
+func filterCidrs(cidrs []string, isV6 bool) ([]string, error) {
+	var res []string
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, &InvalidArgError{Name: "cidr", Value: cidr}
+		}
+		if (ipNet.IP.To4() == nil) == isV6 {
+			res = append(res, ipNet.String())
+		}
+	}
+	return res, nil
+}
@@ -2,16 +2,19 @@ package nettools
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 	"github.com/vishvananda/netlink"
 	"net"
 	"os"
-	"os/exec"
+	"syscall"
 )
 
-func GetBridge() (*netlink.Bridge, error) {
-	brName := "testcni0"
+func GetBridge(brName string) (*netlink.Bridge, error) {
 	l, err := netlink.LinkByName(brName)
 	if err != nil {
 		return nil, err
@@ -32,18 +35,27 @@ func SetVethMaster(veth *netlink.Veth, br *netlink.Bridge) error {
 	return nil
 }
 
-func CreateVethPair(ifName string, mtu int) (*netlink.Veth, *netlink.Veth, error) {
-	var vethPairName string
+func UnsetVethMaster(veth *netlink.Veth) error {
+	err := netlink.LinkSetNoMaster(veth)
+	if err != nil {
+		return fmt.Errorf("remove veth %s from master error: %s", veth.Attrs().Name, err.Error())
+	}
+	return nil
+}
+
+// CreateVethPair 创建一对veth，hostVethName为空时宿主机那头随机起名
+func CreateVethPair(ifName, hostVethName string, mtu int) (*netlink.Veth, *netlink.Veth, error) {
+	vethPairName := hostVethName
 	var err error
-	for {
+	for vethPairName == "" {
 		vethPairName, err = RandomVethName()
 		if err != nil {
 			return nil, nil, fmt.Errorf("generate veth pair error:%s", err.Error())
 		}
 
 		_, err = netlink.LinkByName(vethPairName)
-		if err != nil && !os.IsExist(err) {
-			break
+		if err == nil || os.IsExist(err) {
+			vethPairName = ""
 		}
 	}
 
@@ -81,6 +93,35 @@ func CreateVethPair(ifName string, mtu int) (*netlink.Veth, *netlink.Veth, error
 	return veth1.(*netlink.Veth), veth2.(*netlink.Veth), nil
 }
 
+func IsLinkNotFound(err error) bool {
+	_, ok := err.(netlink.LinkNotFoundError)
+	return ok
+}
+
+// DelLinkByName 删除指定名字的设备，设备不存在时直接返回nil
+func DelLinkByName(name string) error {
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		if IsLinkNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("get link by name:%s error:%s", name, err.Error())
+	}
+	if err = netlink.LinkDel(l); err != nil && !IsLinkNotFound(err) {
+		return fmt.Errorf("delete link:%s error:%s", name, err.Error())
+	}
+	return nil
+}
+
+// HostVethPrefix 按容器生成名字的宿主机veth前缀，GC只清理带这个前缀的设备
+const HostVethPrefix = "tcni"
+
+// HostVethName 根据容器id和网卡名生成宿主机那头veth的名字，GC据此判断veth是否还有主人
+func HostVethName(containerId, ifName string) string {
+	sum := sha256.Sum256([]byte(containerId + "/" + ifName))
+	return HostVethPrefix + hex.EncodeToString(sum[:])[:11]
+}
+
 func RandomVethName() (string, error) {
 	entropy := make([]byte, 4)
 	_, err := rand.Read(entropy)
@@ -110,13 +151,65 @@ func SetIpForVeth(name string, podIP string) error {
 		return fmt.Errorf("failed to transform the ip %s, error : %s", podIP, err.Error())
 	}
 	ipnet.IP = ipaddr
-	err = netlink.AddrAdd(link, &netlink.Addr{IPNet: ipnet})
+	err = netlink.AddrAdd(link, newAddr(ipnet))
 	if err != nil {
 		return fmt.Errorf("can not add the ip %s to device %s, error: %s", podIP, name, err.Error())
 	}
 	return nil
 }
 
+func DelIpForVeth(name string, podIP string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to get device by name %s, error: %s", name, err.Error())
+	}
+
+	ipaddr, ipnet, err := net.ParseCIDR(podIP)
+	if err != nil {
+		return fmt.Errorf("failed to transform the ip %s, error : %s", podIP, err.Error())
+	}
+	ipnet.IP = ipaddr
+	err = netlink.AddrDel(link, &netlink.Addr{IPNet: ipnet})
+	if err != nil {
+		return fmt.Errorf("can not delete the ip %s from device %s, error: %s", podIP, name, err.Error())
+	}
+	return nil
+}
+
+// newAddr ipv6地址跳过DAD，否则地址在tentative状态下无法立即使用
+func newAddr(ipn *net.IPNet) *netlink.Addr {
+	addr := &netlink.Addr{IPNet: ipn}
+	if ipn.IP.To4() == nil {
+		addr.Flags = syscall.IFA_F_NODAD
+	}
+	return addr
+}
+
+func IPFamily(ip net.IP) int {
+	if ip.To4() == nil {
+		return netlink.FAMILY_V6
+	}
+	return netlink.FAMILY_V4
+}
+
+func defaultRouteDst(ip net.IP) *net.IPNet {
+	if IPFamily(ip) == netlink.FAMILY_V6 {
+		_, defNet, _ := net.ParseCIDR("::/0")
+		return defNet
+	}
+	_, defNet, _ := net.ParseCIDR("0.0.0.0/0")
+	return defNet
+}
+
+// EnableIPv6 有的发行版在新建的netns里默认关掉了ipv6，需要打开
+func EnableIPv6(ifName string) error {
+	_, err := sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/disable_ipv6", ifName), "0")
+	if err != nil {
+		return fmt.Errorf("enable ipv6 on %s error:%s", ifName, err.Error())
+	}
+	return nil
+}
+
 func SetUpVeth(veth ...*netlink.Veth) error {
 	for _, v := range veth {
 		err := netlink.LinkSetUp(v)
@@ -128,8 +221,61 @@ func SetUpVeth(veth ...*netlink.Veth) error {
 }
 
 func SetDefaultRouteToVeth(gwIP net.IP, veth netlink.Link) error {
-	_, defNet, _ := net.ParseCIDR("0.0.0.0/0")
-	return AddRoute(defNet, gwIP, veth, 0)
+	return AddRoute(defaultRouteDst(gwIP), gwIP, veth, 0)
+}
+
+func CheckIpOnLink(link netlink.Link, ipn *net.IPNet) error {
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("list addr of %s error:%s", link.Attrs().Name, err.Error())
+	}
+	for _, a := range addrs {
+		if a.IPNet.IP.Equal(ipn.IP) && a.IPNet.Mask.String() == ipn.Mask.String() {
+			return nil
+		}
+	}
+	return fmt.Errorf("ip %s not found on %s", ipn.String(), link.Attrs().Name)
+}
+
+func CheckDefaultRoute(gwIP net.IP, link netlink.Link) error {
+	routes, err := netlink.RouteList(link, IPFamily(gwIP))
+	if err != nil {
+		return fmt.Errorf("list route of %s error:%s", link.Attrs().Name, err.Error())
+	}
+	for _, r := range routes {
+		if r.Dst != nil {
+			if ones, _ := r.Dst.Mask.Size(); ones != 0 {
+				continue
+			}
+		}
+		if r.Gw.Equal(gwIP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("default route via %s not found on %s", gwIP.String(), link.Attrs().Name)
+}
+
+func DelDefaultRouteToVeth(gwIP net.IP, veth netlink.Link) error {
+	return DelRoute(defaultRouteDst(gwIP), gwIP, veth)
+}
+
+func DelRoute(ipn *net.IPNet, gw net.IP, dev netlink.Link) error {
+	return netlink.RouteDel(&netlink.Route{
+		LinkIndex: dev.Attrs().Index,
+		Dst:       ipn,
+		Gw:        gw,
+	})
+}
+
+// ReplaceRoute 和AddRoute一样，但路由已存在时不会报错
+func ReplaceRoute(ipn *net.IPNet, gw net.IP, dev netlink.Link, flag int) error {
+	return netlink.RouteReplace(&netlink.Route{
+		LinkIndex: dev.Attrs().Index,
+		Scope:     netlink.SCOPE_UNIVERSE,
+		Dst:       ipn,
+		Gw:        gw,
+		Flags:     flag,
+	})
 }
 
 func AddRoute(ipn *net.IPNet, gw net.IP, dev netlink.Link, flag int, scope ...netlink.Scope) error {
@@ -146,124 +292,153 @@ func AddRoute(ipn *net.IPNet, gw net.IP, dev netlink.Link, flag int, scope ...ne
 	})
 }
 
-func CreateArpEntry(ip, mac, dev string) error {
-	processInfo := exec.Command(
-		"/bin/bash", "-c",
-		fmt.Sprintf("arp -s %s %s -i %s", ip, mac, dev),
-	)
-	_, err := processInfo.Output()
-	return err
+// InvalidArgError 来自节点注解等外部输入的参数格式不正确
+type InvalidArgError struct {
+	Name  string
+	Value string
 }
 
-func CreateFdbEntry(mac, ip, dev string) error {
-	processInfo := exec.Command(
-		"/bin/bash", "-c",
-		fmt.Sprintf("bridge fdb append %s dev %s dst %s", mac, dev, ip),
-	)
-	_, err := processInfo.Output()
-	return err
+func (e *InvalidArgError) Error() string {
+	return fmt.Sprintf("invalid %s: %q", e.Name, e.Value)
 }
 
-func AddSNat(podCidr, hostIp, dev string) error {
-	processInfo := exec.Command(
-		"/bin/bash", "-c",
-		fmt.Sprintf("iptables -t nat -A POSTROUTING -s %s -o %s -j SNAT --to %s", podCidr, dev, hostIp),
-	)
-	_, err := processInfo.Output()
-	return err
+// NeighError 写入或删除fdb、arp表项失败
+type NeighError struct {
+	Op  string
+	Dev string
+	IP  string
+	Err error
 }
 
-func GetNetNs(namespace string) (*ns.NetNS, error) {
-	netNs, err := ns.GetNS(namespace)
-	if err != nil {
-		return nil, fmt.Errorf("get ns:%s error:%s", namespace, err.Error())
-	}
-	return &netNs, nil
+func (e *NeighError) Error() string {
+	return fmt.Sprintf("%s %s on %s error:%s", e.Op, e.IP, e.Dev, e.Err.Error())
 }
 
-func CreateVxlanAndUp(name string, mtu int, addr *net.IPNet) (*netlink.Vxlan, error) {
-	l, _ := netlink.LinkByName(name)
+func (e *NeighError) Unwrap() error {
+	return e.Err
+}
 
-	vxlan, ok := l.(*netlink.Vxlan)
-	if ok && vxlan != nil {
-		return vxlan, nil
+func parseNeighArgs(ip, mac, dev string) (net.IP, net.HardwareAddr, netlink.Link, error) {
+	parsedIp := net.ParseIP(ip)
+	if parsedIp == nil {
+		return nil, nil, nil, &InvalidArgError{Name: "ip", Value: ip}
 	}
-	vxlan = &netlink.Vxlan{
-		VxlanId: 1,
-		LinkAttrs: netlink.LinkAttrs{
-			Name: name,
-			MTU:  mtu,
-		},
-		Port: 8472,
+	var hwAddr net.HardwareAddr
+	if mac != "" {
+		var err error
+		if hwAddr, err = net.ParseMAC(mac); err != nil {
+			return nil, nil, nil, &InvalidArgError{Name: "mac", Value: mac}
+		}
 	}
-	err := netlink.LinkAdd(vxlan)
+	link, err := netlink.LinkByName(dev)
 	if err != nil {
-		return nil, fmt.Errorf("create vxlan:%s error:%s", name, err.Error())
+		return nil, nil, nil, fmt.Errorf("get link by name:%s error:%w", dev, err)
 	}
+	return parsedIp, hwAddr, link, nil
+}
 
-	l, err = netlink.LinkByName(name)
+// CreateArpEntry 写入永久的邻居表项，ipv4是arp，ipv6是ndp，已存在时直接覆盖
+func CreateArpEntry(ip, mac, dev string) error {
+	parsedIp, hwAddr, link, err := parseNeighArgs(ip, mac, dev)
 	if err != nil {
-		return nil, fmt.Errorf("get vxlan by name:%s error:%s", name, err.Error())
-	}
-
-	vxlan, ok = l.(*netlink.Vxlan)
-	if !ok {
-		return nil, fmt.Errorf("found the device %s but it's not a vxlan", name)
-	}
-	addr.Mask = net.IPv4Mask(255, 255, 255, 255)
-	if err = netlink.AddrAdd(vxlan, &netlink.Addr{IPNet: addr}); err != nil {
-		return nil, fmt.Errorf("can not add the ip %v to vxlan %s, err: %s", addr, name, err.Error())
-	}
-	if err = netlink.LinkSetUp(vxlan); err != nil {
-		return nil, fmt.Errorf("setup vxlan %s error, err: %v", name, err)
+		return err
+	}
+	err = netlink.NeighSet(&netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       IPFamily(parsedIp),
+		State:        netlink.NUD_PERMANENT,
+		Type:         syscall.RTN_UNICAST,
+		IP:           parsedIp,
+		HardwareAddr: hwAddr,
+	})
+	if err != nil {
+		return &NeighError{Op: "set neigh", Dev: dev, IP: ip, Err: err}
 	}
-	return vxlan, nil
+	return nil
 }
 
-func CreateBridge(brName string, gw *net.IPNet, mtu int) (*netlink.Bridge, error) {
-	l, err := netlink.LinkByName(brName)
-	if err != nil && err.Error() != "Link not found" {
-		return nil, fmt.Errorf("found bridge first by name:%s error:%s", brName, err.Error())
-	}
-
-	br, ok := l.(*netlink.Bridge)
-	if ok && br != nil {
-		return br, nil
+// DelArpEntry 删除邻居表项，表项不存在时返回nil
+func DelArpEntry(ip, dev string) error {
+	parsedIp, _, link, err := parseNeighArgs(ip, "", dev)
+	if err != nil {
+		return err
 	}
-
-	br = &netlink.Bridge{
-		LinkAttrs: netlink.LinkAttrs{
-			Name:   brName,
-			MTU:    mtu,
-			TxQLen: -1,
-		},
+	err = netlink.NeighDel(&netlink.Neigh{
+		LinkIndex: link.Attrs().Index,
+		Family:    IPFamily(parsedIp),
+		IP:        parsedIp,
+	})
+	if err != nil && !errors.Is(err, syscall.ENOENT) {
+		return &NeighError{Op: "del neigh", Dev: dev, IP: ip, Err: err}
 	}
+	return nil
+}
 
-	err = netlink.LinkAdd(br)
+// CreateFdbEntry 在vxlan设备上写入mac到对端宿主机ip的转发表项，已存在时直接覆盖
+func CreateFdbEntry(mac, ip, dev string) error {
+	parsedIp, hwAddr, link, err := parseNeighArgs(ip, mac, dev)
+	if err != nil {
+		return err
+	}
+	err = netlink.NeighSet(&netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       syscall.AF_BRIDGE,
+		State:        netlink.NUD_PERMANENT,
+		Flags:        netlink.NTF_SELF,
+		IP:           parsedIp,
+		HardwareAddr: hwAddr,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("can not create bridge:%s, err:%s", brName, err.Error())
+		return &NeighError{Op: "set fdb", Dev: dev, IP: ip, Err: err}
 	}
+	return nil
+}
 
-	//这里需要通过netlink重新获取网桥，否则光创建的话无法从上头拿到其他属性
-	l, err = netlink.LinkByName(brName)
-	if err != nil && err.Error() != "Link not found" {
-		return nil, fmt.Errorf("found bridge second by name:%s error:%s", brName, err.Error())
+// DelFdbEntry 删除转发表项，表项不存在时返回nil
+func DelFdbEntry(mac, ip, dev string) error {
+	parsedIp, hwAddr, link, err := parseNeighArgs(ip, mac, dev)
+	if err != nil {
+		return err
+	}
+	err = netlink.NeighDel(&netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       syscall.AF_BRIDGE,
+		State:        netlink.NUD_PERMANENT,
+		Flags:        netlink.NTF_SELF,
+		IP:           parsedIp,
+		HardwareAddr: hwAddr,
+	})
+	if err != nil && !errors.Is(err, syscall.ENOENT) {
+		return &NeighError{Op: "del fdb", Dev: dev, IP: ip, Err: err}
 	}
+	return nil
+}
 
-	br, ok = l.(*netlink.Bridge)
-	if !ok {
-		return nil, fmt.Errorf("found the device %s but it's not a bridge device", brName)
+func GetNetNs(namespace string) (*ns.NetNS, error) {
+	netNs, err := ns.GetNS(namespace)
+	if err != nil {
+		return nil, fmt.Errorf("get ns:%s error:%w", namespace, err)
 	}
+	return &netNs, nil
+}
 
-	addr := &netlink.Addr{IPNet: gw}
-	if err = netlink.AddrAdd(br, addr); err != nil {
-		return nil, fmt.Errorf("can not add the gw %v to bridge %s, err: %s", addr, brName, err.Error())
-	}
+func IsNetNsNotExist(err error) bool {
+	var e ns.NSPathNotExistErr
+	return errors.As(err, &e)
+}
 
-	if err = netlink.LinkSetUp(br); err != nil {
-		return nil, fmt.Errorf("set up bridge %s error, err: %s", brName, err.Error())
-	}
-	return br, nil
+// VxlanOptions 创建vxlan设备的参数
+type VxlanOptions struct {
+	Name string
+	//和网桥的mtu一致（底层网卡的mtu减去vxlan开销），不再固定为1500，避免封装后的报文超过底层网卡的mtu
+	MTU      int
+	VNI      int
+	Port     int
+	PortLow  int
+	PortHigh int
+	//封装后的报文从哪块网卡、用哪个源地址发出去，多网卡的节点上必须指定
+	VtepDevIndex int
+	SrcAddr      net.IP
 }
 
 func GetHostInterfacesIps() (map[string]string, []string, error) {
@@ -279,7 +454,7 @@ func GetHostInterfacesIps() (map[string]string, []string, error) {
 			return nil, nil, err
 		}
 		for _, addr := range addrs {
-			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() {
 				ipToInterfaceName[ipnet.IP.String()] = i.Name
 				ips = append(ips, ipnet.IP.String())
 			}
@@ -0,0 +1,130 @@
+package plugin
+
+import (
+	"fmt"
+	types "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"net"
+	"test-cni/ipam"
+	"test-cni/nettools"
+	"test-cni/skel"
+	"test-cni/utils"
+)
+
+func Check(args *skel.CmdArgs, pluginConfig *PConf) error {
+	if pluginConfig.RawPrevResult == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+	if err := version.ParsePrevResult(&pluginConfig.NetConf); err != nil {
+		return fmt.Errorf("parse prevResult error:%s", err.Error())
+	}
+	prevResult, err := types.NewResultFromResult(pluginConfig.PrevResult)
+	if err != nil {
+		return fmt.Errorf("convert prevResult error:%s", err.Error())
+	}
+	if len(prevResult.IPs) == 0 {
+		return fmt.Errorf("prevResult has no ip")
+	}
+
+	var gws []net.IP
+	if pluginConfig.delegatedIpam() {
+		//ip由ipam插件分配，记录由它自己检查，网关以ADD的结果为准
+		if err = delegateCheck(args.StdinData, pluginConfig); err != nil {
+			return err
+		}
+		for _, ipc := range prevResult.IPs {
+			if ipc.Gateway == nil {
+				return fmt.Errorf("prevResult has no gateway for %s", ipc.Address.String())
+			}
+			gws = append(gws, ipc.Gateway)
+		}
+	} else if gws, err = checkAttachment(args, pluginConfig, prevResult); err != nil {
+		return err
+	}
+
+	br, err := nettools.GetBridge(pluginConfig.Bridge)
+	if err != nil {
+		return fmt.Errorf("get bridge error:%s", err.Error())
+	}
+
+	netNs, err := nettools.GetNetNs(args.Netns)
+	if err != nil {
+		return err
+	}
+	defer (*netNs).Close()
+
+	return (*netNs).Do(func(hostNs ns.NetNS) error {
+		l, err := netlink.LinkByName(args.IfName)
+		if err != nil {
+			return fmt.Errorf("get %s in netns %s error:%s", args.IfName, args.Netns, err.Error())
+		}
+		containerVeth, ok := l.(*netlink.Veth)
+		if !ok {
+			return fmt.Errorf("%s not a veth device", args.IfName)
+		}
+
+		for _, ipc := range prevResult.IPs {
+			if err = nettools.CheckIpOnLink(containerVeth, &ipc.Address); err != nil {
+				return err
+			}
+		}
+
+		for _, gw := range gws {
+			if err = nettools.CheckDefaultRoute(gw, containerVeth); err != nil {
+				return err
+			}
+		}
+
+		peerIndex, err := netlink.VethPeerIndex(containerVeth)
+		if err != nil {
+			return fmt.Errorf("get peer index of %s error:%s", args.IfName, err.Error())
+		}
+
+		return hostNs.Do(func(_ ns.NetNS) error {
+			hostVeth, err := netlink.LinkByIndex(peerIndex)
+			if err != nil {
+				return fmt.Errorf("get host veth by index %d error:%s", peerIndex, err.Error())
+			}
+			if hostVeth.Attrs().MasterIndex != br.Attrs().Index {
+				return fmt.Errorf("host veth %s not attached to bridge %s", hostVeth.Attrs().Name, br.Attrs().Name)
+			}
+			return nil
+		})
+	})
+}
+
+// checkAttachment 内置分配器的记录必须还在，并且和prevResult一致，返回记录中每个ip的网关
+func checkAttachment(args *skel.CmdArgs, pluginConfig *PConf, prevResult *types.Result) ([]net.IP, error) {
+	//ipam中的记录必须还在，迁移旧版本的存储需要持有锁
+	lock, err := lockIpam(pluginConfig)
+	if err != nil {
+		return nil, err
+	}
+	att, err := ipam.GetAttachment(args.ContainerID, args.IfName)
+	lock.Release()
+	if err != nil {
+		return nil, fmt.Errorf("get ip record of container %s error:%s", args.ContainerID, err.Error())
+	}
+	recordIps := att.IpStrs()
+	for _, ipc := range prevResult.IPs {
+		if !utils.StringsIn(recordIps, ipc.Address.IP.String()) {
+			return nil, fmt.Errorf("ip records of container %s are %v, expected %s", args.ContainerID, recordIps, ipc.Address.IP.String())
+		}
+	}
+
+	//ip可能来自某个ip池，网关以ADD时的记录为准
+	var gws []net.IP
+	for _, attIp := range att.Ips {
+		gw := net.ParseIP(attIp.Gateway)
+		if gw == nil {
+			gw = pluginConfig.gatewayOf(attIp.Address)
+		}
+		if gw == nil {
+			return nil, fmt.Errorf("can not get gw of %s", attIp.Address)
+		}
+		gws = append(gws, gw)
+	}
+	return gws, nil
+}
@@ -0,0 +1,108 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"test-cni/ipam"
+	"test-cni/nettools"
+	"test-cni/skel"
+	"test-cni/utils"
+)
+
+// Teardown 删除pod的网卡和宿主机上的veth，并释放ip
+// 按照CNI规范，DEL需要幂等，任何一样东西已经不存在都不算错误
+func Teardown(args *skel.CmdArgs, pluginConfig *PConf) error {
+	if args.Netns != "" {
+		netNs, err := nettools.GetNetNs(args.Netns)
+		if err != nil {
+			//netns已经被删掉了，里面的veth会被内核连同宿主机那头一起删掉
+			if !nettools.IsNetNsNotExist(err) {
+				return err
+			}
+			utils.LogInfo("netns already gone")
+		} else {
+			defer (*netNs).Close()
+			err = (*netNs).Do(func(hostNs ns.NetNS) error {
+				return delPodVeth(args.IfName, hostNs)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	//拿不到peer的时候（比如netns已经没了）按名字再删一次宿主机那头
+	if err := nettools.DelLinkByName(nettools.HostVethName(args.ContainerID, args.IfName)); err != nil {
+		return err
+	}
+
+	if pluginConfig.delegatedIpam() {
+		return delegateDel(args.StdinData, pluginConfig)
+	}
+
+	lock, err := lockIpam(pluginConfig)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	if err = ipam.Release(args.ContainerID, args.IfName); err != nil {
+		return fmt.Errorf("release ip of container %s error:%s", args.ContainerID, err.Error())
+	}
+	return nil
+}
+
+// ReleaseWithoutConfig 网络配置校验不通过时（比如运维改了conflist），DEL也要释放ip，否则kubelet会一直重试
+// 配置不可信，不拆设备，只按容器id和网卡名释放；还能解析出ipam.type时交给ipam插件释放
+func ReleaseWithoutConfig(args *skel.CmdArgs) error {
+	pluginConfig := &PConf{}
+	if err := json.Unmarshal(args.StdinData, pluginConfig); err == nil && pluginConfig.delegatedIpam() {
+		return delegateDel(args.StdinData, pluginConfig)
+	}
+
+	lock, err := lockIpam(pluginConfig)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	if err = ipam.Release(args.ContainerID, args.IfName); err != nil {
+		return fmt.Errorf("release ip of container %s error:%s", args.ContainerID, err.Error())
+	}
+	return nil
+}
+
+func delPodVeth(ifName string, hostNs ns.NetNS) error {
+	l, err := netlink.LinkByName(ifName)
+	if err != nil {
+		if nettools.IsLinkNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("get %s error:%s", ifName, err.Error())
+	}
+
+	//先记下宿主机那头的名字，删除之后ifindex可能被别的设备复用
+	var hostVethName string
+	if veth, ok := l.(*netlink.Veth); ok {
+		peerIndex, err := netlink.VethPeerIndex(veth)
+		if err == nil {
+			_ = hostNs.Do(func(_ ns.NetNS) error {
+				if peer, err := netlink.LinkByIndex(peerIndex); err == nil {
+					hostVethName = peer.Attrs().Name
+				}
+				return nil
+			})
+		}
+	}
+
+	if err = netlink.LinkDel(l); err != nil && !nettools.IsLinkNotFound(err) {
+		return fmt.Errorf("delete %s error:%s", ifName, err.Error())
+	}
+
+	if hostVethName == "" {
+		return nil
+	}
+	return hostNs.Do(func(_ ns.NetNS) error {
+		return nettools.DelLinkByName(hostVethName)
+	})
+}
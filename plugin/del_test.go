@@ -0,0 +1,43 @@
+package plugin
+
+import (
+	"os"
+	"test-cni/ipam"
+	"test-cni/skel"
+	"testing"
+)
+
+// TestReleaseWithoutConfig 配置校验不通过时DEL仍然按容器id和网卡名释放ip
+func TestReleaseWithoutConfig(t *testing.T) {
+	useTempState(t)
+	allocator := ipam.NewAllocator(&ipam.Range{Subnet: "10.244.0.0/24"})
+	for _, ifName := range []string{"eth0", "net1"} {
+		if _, err := allocator.Allocate(&ipam.Attachment{ContainerId: "del-test", IfName: ifName}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	configs := []string{
+		//mtu不合法，校验不通过
+		`{"cniVersion":"1.0.0","name":"testcni","type":"testcni","subnet":"10.244.0.0/24","mtu":10}`,
+		//不是合法的json
+		`{"cniVersion":`,
+	}
+	for _, conf := range configs {
+		args := &skel.CmdArgs{ContainerID: "del-test", IfName: "eth0", StdinData: []byte(conf)}
+		if GetConfigs(args) != nil {
+			t.Fatalf("GetConfigs(%s) should fail", conf)
+		}
+		//重复DEL也不能报错
+		if err := ReleaseWithoutConfig(args); err != nil {
+			t.Fatalf("ReleaseWithoutConfig(%s) error = %v", conf, err)
+		}
+		if _, err := ipam.GetAttachment("del-test", "eth0"); !os.IsNotExist(err) {
+			t.Fatalf("attachment of eth0 still exists, error:%v", err)
+		}
+	}
+	//同一个容器的其他网卡不受影响
+	if _, err := ipam.GetAttachment("del-test", "net1"); err != nil {
+		t.Fatalf("attachment of net1 error = %v", err)
+	}
+}
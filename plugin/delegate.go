@@ -0,0 +1,158 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"github.com/containernetworking/cni/pkg/invoke"
+	cniTypes "github.com/containernetworking/cni/pkg/types"
+	types "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	cniIpam "github.com/containernetworking/plugins/pkg/ipam"
+	"github.com/vishvananda/netlink"
+	"net"
+	"os"
+	"path/filepath"
+	"test-cni/ipam"
+	"test-cni/utils"
+)
+
+// delegatedIpam 配置了ipam.type时由对应的ipam插件（host-local、static、dhcp等）分配ip，
+// 不配置时使用内置的分配器
+func (c *PConf) delegatedIpam() bool {
+	return c.IPAM.Type != ""
+}
+
+// delegateAdd 调用ipam插件分配ip，返回插件的结果和每个ip对应的网关
+// 网关由daemonset配置在网桥上，插件分配的网段必须和网桥上的地址对得上
+// 失败时插件可能已经分配了ip，调用方需要执行delegateDel
+func delegateAdd(args []byte, pluginConfig *PConf, br *netlink.Bridge) (*types.Result, []*net.IPNet, error) {
+	r, err := cniIpam.ExecAdd(pluginConfig.IPAM.Type, args)
+	if err != nil {
+		return nil, nil, fmt.Errorf("ipam plugin %s add error:%s", pluginConfig.IPAM.Type, err.Error())
+	}
+	ipamResult, err := types.NewResultFromResult(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("convert result of ipam plugin %s error:%s", pluginConfig.IPAM.Type, err.Error())
+	}
+	if len(ipamResult.IPs) == 0 {
+		return nil, nil, fmt.Errorf("ipam plugin %s returned no ip", pluginConfig.IPAM.Type)
+	}
+
+	brAddrs, err := netlink.AddrList(br, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("list addr of %s error:%s", br.Attrs().Name, err.Error())
+	}
+	var gws []*net.IPNet
+	for _, ipc := range ipamResult.IPs {
+		gw := ipc.Gateway
+		//和host-local一样，没有给网关时使用网段的第一个地址
+		if gw == nil {
+			gw = ipam.GetGateway(ipc.Address.String()).IP
+		}
+		var onBridge bool
+		for _, a := range brAddrs {
+			if a.IP.Equal(gw) {
+				onBridge = true
+				break
+			}
+		}
+		if !onBridge {
+			return nil, nil, fmt.Errorf("gateway %s of ip %s is not on bridge %s, the ipam subnet must match the node's pod cidr",
+				gw, ipc.Address.String(), br.Attrs().Name)
+		}
+		gws = append(gws, &net.IPNet{IP: gw, Mask: ipc.Address.Mask})
+	}
+	return ipamResult, gws, nil
+}
+
+// delegateDel 释放ipam插件分配的ip，插件自己保证DEL幂等
+func delegateDel(args []byte, pluginConfig *PConf) error {
+	if err := cniIpam.ExecDel(pluginConfig.IPAM.Type, args); err != nil {
+		return fmt.Errorf("ipam plugin %s del error:%s", pluginConfig.IPAM.Type, err.Error())
+	}
+	return nil
+}
+
+func delegateCheck(args []byte, pluginConfig *PConf) error {
+	if err := cniIpam.ExecCheck(pluginConfig.IPAM.Type, args); err != nil {
+		return fmt.Errorf("ipam plugin %s check error:%s", pluginConfig.IPAM.Type, err.Error())
+	}
+	return nil
+}
+
+// delegateGC GC是CNI 1.1才有的命令，旧版本的ipam插件不认识，跳过
+func delegateGC(args []byte, pluginConfig *PConf) error {
+	ok, err := delegateSupports(pluginConfig.IPAM.Type, "1.1.0")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		utils.LogInfo("ipam plugin does not support GC, skip", "ipam", pluginConfig.IPAM.Type)
+		return nil
+	}
+	if err = invoke.DelegateGC(context.TODO(), pluginConfig.IPAM.Type, args, nil); err != nil {
+		return fmt.Errorf("ipam plugin %s gc error:%s", pluginConfig.IPAM.Type, err.Error())
+	}
+	return nil
+}
+
+// delegateStatus 不支持STATUS的ipam插件按可用处理
+func delegateStatus(args []byte, pluginConfig *PConf) error {
+	ok, err := delegateSupports(pluginConfig.IPAM.Type, "1.1.0")
+	if err != nil {
+		return notAvailable(fmt.Sprintf("ipam plugin %s not ready", pluginConfig.IPAM.Type), err)
+	}
+	if !ok {
+		return nil
+	}
+	if err = invoke.DelegateStatus(context.TODO(), pluginConfig.IPAM.Type, args, nil); err != nil {
+		//ipam插件返回的错误码原样交给运行时
+		if e, ok := err.(*cniTypes.Error); ok {
+			return e
+		}
+		return notAvailable(fmt.Sprintf("ipam plugin %s not ready", pluginConfig.IPAM.Type), err)
+	}
+	return nil
+}
+
+// delegateSupports 在CNI_PATH中找到ipam插件，询问它支持的版本里有没有不低于minVersion的
+func delegateSupports(pluginType, minVersion string) (bool, error) {
+	pluginPath, err := invoke.FindInPath(pluginType, filepath.SplitList(os.Getenv("CNI_PATH")))
+	if err != nil {
+		return false, fmt.Errorf("find ipam plugin %s error:%s", pluginType, err.Error())
+	}
+	info, err := invoke.GetVersionInfo(context.TODO(), pluginPath, nil)
+	if err != nil {
+		return false, fmt.Errorf("get version of ipam plugin %s error:%s", pluginType, err.Error())
+	}
+	for _, v := range info.SupportedVersions() {
+		if ok, err := version.GreaterThanOrEqualTo(v, minVersion); err == nil && ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// extraRoutes ipam插件结果中的非默认路由，没有下一跳的使用同一个地址族的网关
+func extraRoutes(ipamResult *types.Result, gws []*net.IPNet) []*cniTypes.Route {
+	if ipamResult == nil {
+		return nil
+	}
+	var routes []*cniTypes.Route
+	for _, r := range ipamResult.Routes {
+		if ones, _ := r.Dst.Mask.Size(); ones == 0 {
+			continue
+		}
+		route := *r
+		if route.GW == nil {
+			for _, gw := range gws {
+				if (gw.IP.To4() == nil) == (r.Dst.IP.To4() == nil) {
+					route.GW = gw.IP
+					break
+				}
+			}
+		}
+		routes = append(routes, &route)
+	}
+	return routes
+}
@@ -0,0 +1,103 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	cniTypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+	"strings"
+	"test-cni/ipam"
+	"test-cni/nettools"
+	"test-cni/skel"
+	"test-cni/utils"
+)
+
+// GC 释放不在cni.dev/valid-attachments中的ip预留和宿主机veth
+// 运行时在GC时传入的是这个网络上所有仍然有效的attachment，其余的都是漏掉DEL留下的
+func GC(args *skel.CmdArgs, pluginConfig *PConf) error {
+	validAttachments := make(map[cniTypes.GCAttachment]bool)
+	validVeths := make(map[string]bool)
+	for _, a := range pluginConfig.ValidAttachments {
+		validAttachments[a] = true
+		validVeths[nettools.HostVethName(a.ContainerID, a.IfName)] = true
+	}
+
+	var errs []error
+	if pluginConfig.delegatedIpam() {
+		//ip由ipam插件分配，运行时传来的有效attachment原样交给它回收
+		if err := delegateGC(args.StdinData, pluginConfig); err != nil {
+			errs = append(errs, err)
+		}
+	} else {
+		//和ADD共用一把锁，避免把正在ADD的容器当成垃圾
+		lock, err := lockIpam(pluginConfig)
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+		if err = gcReservations(pluginConfig.Name, true, validAttachments); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := gcHostVeths(pluginConfig.Bridge, validVeths); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// gcReservations 释放network这个网络中不属于任何有效attachment的ip预留，调用方需要持有锁
+// 存储可能和testcni-ipam共用，其他网络的记录不动；旧版本的记录没有网络名，只有ownsLegacy时才处理
+func gcReservations(network string, ownsLegacy bool, validAttachments map[cniTypes.GCAttachment]bool) error {
+	var errs []error
+	reservations, err := ipam.ListReservations()
+	if err != nil {
+		return fmt.Errorf("list reservations error:%s", err.Error())
+	}
+	for _, r := range reservations {
+		if r.Network != network && (r.Network != "" || !ownsLegacy) {
+			continue
+		}
+		if r.ContainerId != "" && validAttachments[cniTypes.GCAttachment{ContainerID: r.ContainerId, IfName: r.IfName}] {
+			continue
+		}
+		if err = ipam.ReleaseReservation(r); err != nil {
+			errs = append(errs, fmt.Errorf("release %v of container %s error:%s", r.Ips, r.ContainerId, err.Error()))
+			continue
+		}
+		utils.LogInfo("gc released ip", "gcContainerID", r.ContainerId, "gcIfName", r.IfName, "ips", r.Ips)
+	}
+	return errors.Join(errs...)
+}
+
+// gcHostVeths 删掉挂在网桥上、按容器起名但已经不属于任何有效attachment的veth
+// 旧版本随机起名的veth无法判断归属，不做处理
+func gcHostVeths(brName string, validVeths map[string]bool) error {
+	br, err := nettools.GetBridge(brName)
+	if err != nil {
+		if nettools.IsLinkNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("get bridge error:%s", err.Error())
+	}
+	links, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("list links error:%s", err.Error())
+	}
+	var errs []error
+	for _, l := range links {
+		name := l.Attrs().Name
+		if _, ok := l.(*netlink.Veth); !ok || l.Attrs().MasterIndex != br.Index {
+			continue
+		}
+		if !strings.HasPrefix(name, nettools.HostVethPrefix) || validVeths[name] {
+			continue
+		}
+		if err = nettools.DelLinkByName(name); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		utils.LogInfo("gc deleted host veth", "veth", name)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,134 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	cniTypes "github.com/containernetworking/cni/pkg/types"
+	types "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	"test-cni/ipam"
+	"test-cni/skel"
+	"test-cni/utils"
+)
+
+// IpamConf testcni-ipam作为独立的ipam插件时的配置
+// 分配相关的字段写在ipam块中，和test-cni顶层的字段一致，macvlan、ipvlan等插件可以和test-cni共用一份ip存储
+type IpamConf struct {
+	PConf
+	//ADD结果中带上的路由，主插件按这些路由配置容器
+	Routes []*cniTypes.Route `json:"routes"`
+}
+
+// GetIpamConfigs 解析testcni-ipam的配置，cniVersion、name、runtimeConfig等取自主插件的顶层配置
+func GetIpamConfigs(args *skel.CmdArgs) *IpamConf {
+	netConf := &struct {
+		cniTypes.NetConf
+		RuntimeConfig json.RawMessage `json:"runtimeConfig"`
+		IPAM          json.RawMessage `json:"ipam"`
+	}{}
+	if err := json.Unmarshal(args.StdinData, netConf); err != nil {
+		return nil
+	}
+	ipamConfig := &IpamConf{}
+	if len(netConf.IPAM) > 0 {
+		if err := json.Unmarshal(netConf.IPAM, ipamConfig); err != nil {
+			utils.LogError("parse ipam config error", "error", err.Error())
+			return nil
+		}
+	}
+	if len(netConf.RuntimeConfig) > 0 {
+		if err := json.Unmarshal(netConf.RuntimeConfig, &ipamConfig.RuntimeConfig); err != nil {
+			utils.LogError("parse runtimeConfig error", "error", err.Error())
+			return nil
+		}
+	}
+	//ipam.type就是testcni-ipam自己，不能当成委托给别的ipam插件
+	ipamConfig.NetConf = netConf.NetConf
+	ipamConfig.IPAM = cniTypes.IPAM{}
+	if loadConfig(args, &ipamConfig.PConf) == nil {
+		return nil
+	}
+	return ipamConfig
+}
+
+// IpamAdd 用内置分配器分配ip，只返回ip、网关和路由，网卡由主插件配置
+func IpamAdd(args *skel.CmdArgs, ipamConfig *IpamConf) (*types.Result, error) {
+	requested, ranges, err := prepareAllocation(&ipamConfig.PConf)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := lockIpam(&ipamConfig.PConf)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release()
+
+	podIPs, gws, err := allocateIps(args, &ipamConfig.PConf, ranges, requested)
+	if err != nil {
+		return nil, err
+	}
+	result := &types.Result{
+		CNIVersion: ipamConfig.CNIVersion,
+		Routes:     ipamConfig.Routes,
+	}
+	for i, podIP := range podIPs {
+		result.IPs = append(result.IPs, &types.IPConfig{
+			Address: *podIP,
+			Gateway: gws[i].IP,
+		})
+	}
+	return result, nil
+}
+
+// IpamDel 释放这个容器网卡的ip，记录已经不存在时不算错误
+func IpamDel(args *skel.CmdArgs, ipamConfig *IpamConf) error {
+	lock, err := lockIpam(&ipamConfig.PConf)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	if err = ipam.Release(args.ContainerID, args.IfName); err != nil {
+		return fmt.Errorf("release ip of container %s error:%s", args.ContainerID, err.Error())
+	}
+	return nil
+}
+
+// IpamCheck 记录必须还在，并且和prevResult中的ip一致
+func IpamCheck(args *skel.CmdArgs, ipamConfig *IpamConf) error {
+	if ipamConfig.RawPrevResult == nil {
+		return fmt.Errorf("required prevResult missing")
+	}
+	if err := version.ParsePrevResult(&ipamConfig.NetConf); err != nil {
+		return fmt.Errorf("parse prevResult error:%s", err.Error())
+	}
+	prevResult, err := types.NewResultFromResult(ipamConfig.PrevResult)
+	if err != nil {
+		return fmt.Errorf("convert prevResult error:%s", err.Error())
+	}
+	_, err = checkAttachment(args, &ipamConfig.PConf, prevResult)
+	return err
+}
+
+// IpamGC 只回收这个网络的预留，同一个节点上其他网络的记录不动
+func IpamGC(args *skel.CmdArgs, ipamConfig *IpamConf) error {
+	validAttachments := make(map[cniTypes.GCAttachment]bool)
+	for _, a := range ipamConfig.ValidAttachments {
+		validAttachments[a] = true
+	}
+
+	lock, err := lockIpam(&ipamConfig.PConf)
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+	return gcReservations(ipamConfig.Name, false, validAttachments)
+}
+
+// IpamStatus ipam存储可写就能接受ADD
+func IpamStatus(args *skel.CmdArgs, ipamConfig *IpamConf) error {
+	if err := ipam.CheckWritable(); err != nil {
+		return notAvailable("ipam store not writable", err)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"time"
+)
+
+// apiTimeout 访问apiserver的超时时间，避免apiserver不可用时ADD一直卡住
+const apiTimeout = 10 * time.Second
+
+// getPodAnnotations 通过kubeconfig读取pod的注解，没有配置kubeconfig或者不是kubelet调用时返回空
+func getPodAnnotations(pluginConfig *PConf) (map[string]string, error) {
+	namespace, name := pluginConfig.K8sArgs.PodNamespace(), pluginConfig.K8sArgs.PodName()
+	if pluginConfig.Kubeconfig == "" || namespace == "" || name == "" {
+		return nil, nil
+	}
+	config, err := clientcmd.BuildConfigFromFlags("", pluginConfig.Kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("load kubeconfig %s error:%s", pluginConfig.Kubeconfig, err.Error())
+	}
+	config.Timeout = apiTimeout
+	clientSet, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("create kubernetes client error:%s", err.Error())
+	}
+	pod, err := clientSet.CoreV1().Pods(namespace).Get(context.TODO(), name, v1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("get pod %s/%s error:%s", namespace, name, err.Error())
+	}
+	return pod.Annotations, nil
+}
@@ -0,0 +1,18 @@
+package plugin
+
+import (
+	"test-cni/skel"
+	"test-cni/utils"
+)
+
+// SetLogFields 让这次调用的所有日志都带上命令和容器信息，方便按pod检索
+func SetLogFields(command string, args *skel.CmdArgs) {
+	utils.SetLogFields("command", command, "containerID", args.ContainerID, "netns", args.Netns, "ifName", args.IfName)
+}
+
+// SetPodLogFields kubelet调用时带上pod的命名空间和名字，其他运行时可能没有
+func (c *PConf) SetPodLogFields() {
+	if name := c.K8sArgs.PodName(); name != "" {
+		utils.SetLogFields("podNamespace", c.K8sArgs.PodNamespace(), "podName", name)
+	}
+}
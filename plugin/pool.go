@@ -0,0 +1,114 @@
+package plugin
+
+import (
+	"fmt"
+	"net"
+	"test-cni/ipam"
+)
+
+// PoolAnnotation pod上指定ip池名字的注解，优先于按命名空间选择
+const PoolAnnotation = "test-cni/pool"
+
+// Pool 一个命名的ip池，每个地址族最多一个范围，和节点的pod网段一样挂在网桥上
+// 没有给这个节点配置网段的池Ranges为空，匹配到的pod不能退回到节点的pod网段
+type Pool struct {
+	Name string `json:"name"`
+	//使用这个池的命名空间
+	Namespaces []string      `json:"namespaces"`
+	Ranges     []*ipam.Range `json:"ranges"`
+}
+
+func (p *Pool) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("pool name can not be empty")
+	}
+	families := make(map[bool]string)
+	for _, r := range p.Ranges {
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("pool %s: %s", p.Name, err.Error())
+		}
+		isV6 := ipam.IsIPv6Cidr(r.Subnet)
+		if other, ok := families[isV6]; ok {
+			return fmt.Errorf("pool %s: subnet %s and %s are in the same ip family", p.Name, other, r.Subnet)
+		}
+		families[isV6] = r.Subnet
+	}
+	return nil
+}
+
+// validatePools 池的名字不能重复，一个命名空间只能属于一个池，所有子网（包括节点的pod网段）不能重叠
+func (c *PConf) validatePools() error {
+	names := make(map[string]bool)
+	namespaces := make(map[string]string)
+	subnets := c.GetSubnets()
+	for _, p := range c.Pools {
+		if err := p.validate(); err != nil {
+			return err
+		}
+		if names[p.Name] {
+			return fmt.Errorf("duplicate pool name:%s", p.Name)
+		}
+		names[p.Name] = true
+		for _, ns := range p.Namespaces {
+			if other, ok := namespaces[ns]; ok {
+				return fmt.Errorf("namespace %s is in both pool %s and %s", ns, other, p.Name)
+			}
+			namespaces[ns] = p.Name
+		}
+		for _, r := range p.Ranges {
+			subnets = append(subnets, r.Subnet)
+		}
+	}
+	return ipam.CheckOverlap(subnets)
+}
+
+// selectRanges 按pod注解、命名空间的顺序选择ip池，都没有匹配时使用节点的pod网段
+// 集群ipam模式下没有匹配的池时返回空，由allocateIps在锁内选择地址块
+// 匹配到的池在本节点没有网段时报错，不能把这个池的pod放到节点的pod网段里
+func (c *PConf) selectRanges(annotations map[string]string) (string, []*ipam.Range, error) {
+	if name := annotations[PoolAnnotation]; name != "" {
+		for _, p := range c.Pools {
+			if p.Name == name {
+				return p.selected()
+			}
+		}
+		return "", nil, fmt.Errorf("pool %s in annotation %s not found", name, PoolAnnotation)
+	}
+	namespace := c.K8sArgs.PodNamespace()
+	for _, p := range c.Pools {
+		for _, ns := range p.Namespaces {
+			if ns == namespace {
+				return p.selected()
+			}
+		}
+	}
+	return "", c.GetRanges(), nil
+}
+
+func (p *Pool) selected() (string, []*ipam.Range, error) {
+	if len(p.Ranges) == 0 {
+		return "", nil, fmt.Errorf("pool %s has no ranges on this node", p.Name)
+	}
+	return p.Name, p.Ranges, nil
+}
+
+// gatewayOf 旧版本的记录里没有网关，根据ip所在的子网或者池找到网关
+func (c *PConf) gatewayOf(address string) net.IP {
+	ip := net.ParseIP(address)
+	if addr, _, err := net.ParseCIDR(address); err == nil {
+		ip = addr
+	}
+	if ip == nil {
+		return nil
+	}
+	ranges := append(c.GetRanges(), c.blockRanges...)
+	for _, p := range c.Pools {
+		ranges = append(ranges, p.Ranges...)
+	}
+	for _, r := range ranges {
+		if ipNet := ipam.CidrToIpNet(r.Subnet); ipNet != nil && ipNet.Contains(ip) {
+			return r.GetGateway().IP
+		}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package plugin
+
+import (
+	"test-cni/utils"
+)
+
+// rollback 记录ADD过程中每一步对应的撤销操作，失败时按相反顺序执行
+type rollback struct {
+	steps []rollbackStep
+}
+
+type rollbackStep struct {
+	name string
+	undo func() error
+}
+
+func (r *rollback) add(name string, undo func() error) {
+	r.steps = append(r.steps, rollbackStep{name: name, undo: undo})
+}
+
+func (r *rollback) run() {
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		if err := r.steps[i].undo(); err != nil {
+			utils.LogError("rollback error", "step", r.steps[i].name, "error", err.Error())
+		}
+	}
+	r.steps = nil
+}
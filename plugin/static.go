@@ -0,0 +1,63 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	cniTypes "github.com/containernetworking/cni/pkg/types"
+	"net"
+	"strings"
+	"test-cni/ipam"
+)
+
+// 固定ip相关的错误码，CNI规范中100以上留给插件自己定义
+const (
+	ErrInvalidRequestedIp  uint = 100
+	ErrRequestedIpConflict uint = 101
+)
+
+// StaticIpAnnotation pod上指定固定ip的注解，双栈时用逗号分隔
+const StaticIpAnnotation = "test-cni/ips"
+
+// requestedIps 返回这次ADD请求的固定ip，都没有时返回空
+// 优先级：runtimeConfig.ips > CNI_ARGS中的IP > pod注解
+func requestedIps(pluginConfig *PConf, annotations map[string]string) ([]net.IP, error) {
+	var raw []string
+	switch {
+	case pluginConfig.RuntimeConfig != nil && len(pluginConfig.RuntimeConfig.IPs) > 0:
+		raw = pluginConfig.RuntimeConfig.IPs
+	case pluginConfig.K8sArgs.IP != "":
+		raw = strings.Split(string(pluginConfig.K8sArgs.IP), ",")
+	case annotations[StaticIpAnnotation] != "":
+		raw = strings.Split(annotations[StaticIpAnnotation], ",")
+	}
+
+	var ips []net.IP
+	for _, s := range raw {
+		s = strings.TrimSpace(s)
+		//runtimeConfig.ips里的地址带掩码，掩码以子网为准
+		ip := net.ParseIP(s)
+		if ip == nil {
+			if addr, _, err := net.ParseCIDR(s); err == nil {
+				ip = addr
+			}
+		}
+		if ip == nil {
+			return nil, cniTypes.NewError(ErrInvalidRequestedIp, fmt.Sprintf("invalid requested ip %q", s), "")
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// requestedIpError 把ipam返回的固定ip错误转换成带错误码的CNI错误，其他错误原样返回
+func requestedIpError(err error) error {
+	var reqErr *ipam.RequestedIpError
+	if !errors.As(err, &reqErr) {
+		return err
+	}
+	code := ErrInvalidRequestedIp
+	if reqErr.Conflict {
+		code = ErrRequestedIpConflict
+	}
+	return cniTypes.NewError(code, reqErr.Error(), "")
+}
@@ -0,0 +1,42 @@
+package plugin
+
+import (
+	"fmt"
+	cniTypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/vishvananda/netlink"
+	"test-cni/ipam"
+	"test-cni/nettools"
+	"test-cni/skel"
+)
+
+// ErrPluginNotAvailable CNI 1.1规范中STATUS表示插件还不能接受ADD的错误码
+const ErrPluginNotAvailable uint = 50
+
+// Status 网桥和vxlan设备都由daemonset创建，它们就绪并且ipam存储可写之后才能接受ADD
+// ip交给ipam插件分配时，由ipam插件判断自己是否可用
+func Status(args *skel.CmdArgs, pluginConfig *PConf) error {
+	if _, err := nettools.GetBridge(pluginConfig.Bridge); err != nil {
+		return notAvailable(fmt.Sprintf("bridge %s not ready", pluginConfig.Bridge), err)
+	}
+
+	l, err := netlink.LinkByName(pluginConfig.VxlanDevice)
+	if err != nil {
+		return notAvailable(fmt.Sprintf("vxlan device %s not ready", pluginConfig.VxlanDevice), err)
+	}
+	if _, ok := l.(*netlink.Vxlan); !ok {
+		return cniTypes.NewError(ErrPluginNotAvailable, fmt.Sprintf("vxlan device %s not ready", pluginConfig.VxlanDevice),
+			fmt.Sprintf("found the device %s but it's not a vxlan", pluginConfig.VxlanDevice))
+	}
+
+	if pluginConfig.delegatedIpam() {
+		return delegateStatus(args.StdinData, pluginConfig)
+	}
+	if err = ipam.CheckWritable(); err != nil {
+		return notAvailable("ipam store not writable", err)
+	}
+	return nil
+}
+
+func notAvailable(msg string, err error) *cniTypes.Error {
+	return cniTypes.NewError(ErrPluginNotAvailable, msg, err.Error())
+}
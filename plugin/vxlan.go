@@ -8,6 +8,7 @@ import (
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/vishvananda/netlink"
 	"net"
+	"strings"
 	"test-cni/ipam"
 	"test-cni/nettools"
 	"test-cni/skel"
@@ -19,9 +20,183 @@ type PConf struct {
 	cniTypes.NetConf
 	RuntimeConfig *struct {
 		TestConfig map[string]interface{} `json:"testConfig"`
+		//ips capability，运行时请求的固定ip
+		IPs []string `json:"ips"`
 	} `json:"runtimeConfig"`
 
 	Subnet string `json:"subnet"`
+	//双栈时每个地址族一个子网，不填时使用Subnet
+	Subnets []string `json:"subnets"`
+	//自动分配的范围、排除的网段和网关，按所在的子网生效，只能和subnet、subnets一起使用
+	RangeStart string   `json:"rangeStart"`
+	RangeEnd   string   `json:"rangeEnd"`
+	Exclude    []string `json:"exclude"`
+	Gateway    string   `json:"gateway"`
+	//每个子网单独配置范围，不填时由subnet、subnets和上面的字段生成
+	Ranges []*ipam.Range `json:"ranges"`
+	//集群ipam模式下本节点分到的地址块，由daemonset维护，每个地址族按顺序选还有空闲ip的块
+	//只能和exclude一起使用，不能和subnet、subnets、ranges一起使用
+	Blocks []string `json:"blocks"`
+	//命名的ip池，按pod注解或者命名空间选择，都不匹配时使用上面的子网
+	Pools []*Pool `json:"pools"`
+	//获取ipam锁的超时时间，单位秒，不填使用defaultLockTimeout
+	LockTimeout int `json:"lockTimeout"`
+	//ip释放之后多少秒内不会被再次自动分配，不填时不限制
+	IpQuarantine int `json:"ipQuarantine"`
+	//日志路径、级别和轮转配置，不填使用默认值
+	Log *utils.LogConfig `json:"log"`
+	//daemonset写入的kubeconfig，用来读取pod注解，不填时不读注解，ADD也不访问apiserver
+	Kubeconfig string `json:"kubeconfig"`
+	//mtu、网桥名等设备配置，和daemonset写入的配置一致
+	nettools.DeviceConfig
+
+	//从CNI_ARGS中解析出来的pod信息，不在配置文件里
+	K8sArgs K8sArgs `json:"-"`
+	//CNI_ARGS解析失败时K8sArgs为空，只有ADD需要pod信息时才报错
+	k8sArgsErr error
+	cniArgs    string
+	//由Blocks和exclude生成，validate之后才有值
+	blockRanges []*ipam.Range
+}
+
+// K8sArgs kubelet通过CNI_ARGS传入的参数，出现未知的key时报错，除非同时传了IgnoreUnknown=1
+type K8sArgs struct {
+	cniTypes.CommonArgs
+	K8S_POD_NAMESPACE          cniTypes.UnmarshallableString
+	K8S_POD_NAME               cniTypes.UnmarshallableString
+	K8S_POD_INFRA_CONTAINER_ID cniTypes.UnmarshallableString
+	K8S_POD_UID                cniTypes.UnmarshallableString
+	//请求的固定ip，双栈时用逗号分隔
+	IP cniTypes.UnmarshallableString
+}
+
+func (a *K8sArgs) PodNamespace() string {
+	return string(a.K8S_POD_NAMESPACE)
+}
+
+func (a *K8sArgs) PodName() string {
+	return string(a.K8S_POD_NAME)
+}
+
+const defaultLockTimeout = 60 * time.Second
+
+func (c *PConf) GetLockTimeout() time.Duration {
+	if c.LockTimeout <= 0 {
+		return defaultLockTimeout
+	}
+	return time.Duration(c.LockTimeout) * time.Second
+}
+
+// GetRanges 返回每个子网的分配范围，validate之后才有值
+func (c *PConf) GetRanges() []*ipam.Range {
+	return c.Ranges
+}
+
+// GetSubnets 返回所有子网，集群ipam模式下是本节点的地址块
+func (c *PConf) GetSubnets() []string {
+	var subnets []string
+	for _, r := range append(c.GetRanges(), c.blockRanges...) {
+		subnets = append(subnets, r.Subnet)
+	}
+	return subnets
+}
+
+// rangesFromSubnets 兼容只配置了subnet、subnets的写法，顶层的rangeStart等字段归到所在子网的范围中
+func (c *PConf) rangesFromSubnets() ([]*ipam.Range, error) {
+	subnets := c.Subnets
+	if len(subnets) == 0 && c.Subnet != "" {
+		subnets = []string{c.Subnet}
+	}
+	return c.rangesFrom(subnets)
+}
+
+func (c *PConf) rangesFrom(subnets []string) ([]*ipam.Range, error) {
+	var ranges []*ipam.Range
+	for _, subnet := range subnets {
+		ranges = append(ranges, &ipam.Range{Subnet: subnet})
+	}
+	rangeOf := func(name, value string, ip net.IP) (*ipam.Range, error) {
+		for _, r := range ranges {
+			if ipNet := ipam.CidrToIpNet(r.Subnet); ipNet != nil && ip != nil && ipNet.Contains(ip) {
+				return r, nil
+			}
+		}
+		return nil, fmt.Errorf("%s %s is not in subnets %v", name, value, subnets)
+	}
+
+	fields := []struct {
+		name  string
+		value string
+		set   func(r *ipam.Range)
+	}{
+		{"rangeStart", c.RangeStart, func(r *ipam.Range) { r.RangeStart = c.RangeStart }},
+		{"rangeEnd", c.RangeEnd, func(r *ipam.Range) { r.RangeEnd = c.RangeEnd }},
+		{"gateway", c.Gateway, func(r *ipam.Range) { r.Gateway = c.Gateway }},
+	}
+	for _, f := range fields {
+		if f.value == "" {
+			continue
+		}
+		r, err := rangeOf(f.name, f.value, net.ParseIP(f.value))
+		if err != nil {
+			return nil, err
+		}
+		f.set(r)
+	}
+	for _, cidr := range c.Exclude {
+		ipNet := ipam.CidrToIpNet(cidr)
+		if ipNet == nil {
+			return nil, fmt.Errorf("invalid exclude:%s", cidr)
+		}
+		r, err := rangeOf("exclude", cidr, ipNet.IP)
+		if err != nil {
+			return nil, err
+		}
+		r.Exclude = append(r.Exclude, cidr)
+	}
+	return ranges, nil
+}
+
+func (c *PConf) validate() error {
+	c.DeviceConfig.SetDefaults()
+	if err := c.DeviceConfig.Validate(); err != nil {
+		return err
+	}
+	//ip交给ipam插件分配时，内置分配器的配置不会生效，配了说明写错了
+	if c.delegatedIpam() {
+		if c.Subnet != "" || len(c.Subnets) > 0 || len(c.Ranges) > 0 || len(c.Blocks) > 0 || len(c.Pools) > 0 ||
+			c.RangeStart != "" || c.RangeEnd != "" || len(c.Exclude) > 0 || c.Gateway != "" {
+			return fmt.Errorf("ipam.type %s can not be used with subnet, subnets, ranges, blocks, pools, rangeStart, rangeEnd, exclude or gateway", c.IPAM.Type)
+		}
+		return nil
+	}
+	if len(c.Blocks) > 0 {
+		return c.validateBlocks()
+	}
+	if len(c.Ranges) == 0 {
+		ranges, err := c.rangesFromSubnets()
+		if err != nil {
+			return err
+		}
+		c.Ranges = ranges
+	} else if c.Subnet != "" || len(c.Subnets) > 0 || c.RangeStart != "" || c.RangeEnd != "" || len(c.Exclude) > 0 || c.Gateway != "" {
+		return fmt.Errorf("ranges can not be used with subnet, subnets, rangeStart, rangeEnd, exclude or gateway")
+	}
+	if len(c.Ranges) == 0 {
+		return fmt.Errorf("subnet can not be empty")
+	}
+	families := make(map[bool]string)
+	for _, r := range c.Ranges {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+		isV6 := ipam.IsIPv6Cidr(r.Subnet)
+		if other, ok := families[isV6]; ok {
+			return fmt.Errorf("subnet %s and %s are in the same ip family", other, r.Subnet)
+		}
+		families[isV6] = r.Subnet
+	}
+	return c.validatePools()
 }
 
 func GetConfigs(args *skel.CmdArgs) *PConf {
@@ -29,60 +204,260 @@ func GetConfigs(args *skel.CmdArgs) *PConf {
 	if err := json.Unmarshal(args.StdinData, pluginConfig); err != nil {
 		return nil
 	}
+	return loadConfig(args, pluginConfig)
+}
+
+// validateBlocks 地址块由daemonset从集群网段中切出来，网关固定是块中的第一个ip
+func (c *PConf) validateBlocks() error {
+	if c.Subnet != "" || len(c.Subnets) > 0 || len(c.Ranges) > 0 || c.RangeStart != "" || c.RangeEnd != "" || c.Gateway != "" {
+		return fmt.Errorf("blocks can not be used with subnet, subnets, ranges, rangeStart, rangeEnd or gateway")
+	}
+	ranges, err := c.rangesFrom(c.Blocks)
+	if err != nil {
+		return err
+	}
+	for _, r := range ranges {
+		if err = r.Validate(); err != nil {
+			return err
+		}
+	}
+	c.blockRanges = ranges
+	return c.validatePools()
+}
+
+// loadConfig 校验配置并解析CNI_ARGS，配置出错时记录日志并返回nil
+// CNI_ARGS解析失败不影响DEL等命令，记下错误继续，ADD需要pod信息时再报错
+func loadConfig(args *skel.CmdArgs, pluginConfig *PConf) *PConf {
+	if err := pluginConfig.validate(); err != nil {
+		utils.LogError("validate plugin config error", "error", err.Error())
+		return nil
+	}
+	pluginConfig.cniArgs = args.Args
+	if err := cniTypes.LoadArgs(args.Args, &pluginConfig.K8sArgs); err != nil {
+		utils.LogWarn("parse CNI_ARGS error, ignore pod info", "args", args.Args, "error", err.Error())
+		pluginConfig.K8sArgs = K8sArgs{}
+		pluginConfig.k8sArgsErr = err
+	}
 	return pluginConfig
 }
 
-func Bootstrap(args *skel.CmdArgs, pluginConfig *PConf, containerId string) (*types.Result, error) {
-	defer utils.ReleaseLock()
-	var podIP *net.IPNet
-	for {
-		ok, err := utils.AcquireLock()
+// k8sArgsError 读取pod注解、按命名空间选ip池、CNI_ARGS中请求了固定ip时需要pod信息，CNI_ARGS解析失败就不能继续分配
+func (c *PConf) k8sArgsError() error {
+	if c.k8sArgsErr == nil {
+		return nil
+	}
+	if c.Kubeconfig == "" && len(c.Pools) == 0 && !hasCniArg(c.cniArgs, "IP") {
+		return nil
+	}
+	return cniTypes.NewError(cniTypes.ErrInvalidEnvironmentVariables, fmt.Sprintf("parse CNI_ARGS %q error:%s", c.cniArgs, c.k8sArgsErr.Error()), "")
+}
+
+func hasCniArg(args, key string) bool {
+	for _, pair := range strings.Split(args, ";") {
+		if k, _, _ := strings.Cut(pair, "="); k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// lockIpam 获取ipam锁，并把旧版本的存储迁移成attachment记录
+func lockIpam(pluginConfig *PConf) (*utils.FileLock, error) {
+	lock, err := utils.AcquireLock(pluginConfig.GetLockTimeout())
+	if err != nil {
+		return nil, fmt.Errorf("AcquireLock error:%w", err)
+	}
+	if err = ipam.Migrate(); err != nil {
+		lock.Release()
+		return nil, fmt.Errorf("migrate ipam store error:%s", err.Error())
+	}
+	return lock, nil
+}
+
+// prepareAllocation 返回内置分配器这次ADD请求的固定ip和使用的子网
+// 配置了kubeconfig时读取pod注解需要访问apiserver，要在拿锁之前调用
+// 注解里可能有固定ip，读取失败时不能当成没有注解继续分配
+func prepareAllocation(pluginConfig *PConf) ([]net.IP, []*ipam.Range, error) {
+	if err := pluginConfig.k8sArgsError(); err != nil {
+		return nil, nil, err
+	}
+	annotations, err := getPodAnnotations(pluginConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	requested, err := requestedIps(pluginConfig, annotations)
+	if err != nil {
+		return nil, nil, err
+	}
+	pool, ranges, err := pluginConfig.selectRanges(annotations)
+	if err != nil {
+		return nil, nil, cniTypes.NewError(cniTypes.ErrInvalidNetworkConfig, err.Error(), "")
+	}
+	if pool != "" {
+		utils.LogInfo("use ip pool", "pool", pool)
+	}
+	return requested, ranges, nil
+}
+
+// allocateIps 用内置分配器分配ip，返回每个ip和对应的网关，调用方需要持有锁
+func allocateIps(args *skel.CmdArgs, pluginConfig *PConf, ranges []*ipam.Range, requested []net.IP) ([]*net.IPNet, []*net.IPNet, error) {
+	//没有选中ip池时，集群ipam模式在锁内选出这次使用的地址块
+	//配置是拿锁之前读的，等锁期间daemonset可能已经释放了其中的地址块，以锁内读到的为准
+	if len(ranges) == 0 && len(pluginConfig.blockRanges) > 0 {
+		blocks, err := ipam.ActiveBlocks(pluginConfig.blockRanges)
 		if err != nil {
-			return nil, fmt.Errorf("AcquireLock error:%s", err.Error())
+			return nil, nil, fmt.Errorf("read node blocks error:%s", err.Error())
 		}
-		if !ok {
-			time.Sleep(1 * time.Second)
-			continue
+		quarantine := time.Duration(pluginConfig.IpQuarantine) * time.Second
+		picked, err := ipam.PickBlocks(blocks, requested, quarantine)
+		if err != nil {
+			return nil, nil, requestedIpError(err)
 		}
-		podIP = ipam.GetUnusedIp(pluginConfig.Subnet)
-		if podIP == nil {
-			return nil, fmt.Errorf("can not allocation ip address from subnet:%s", pluginConfig.Subnet)
+		ranges = picked
+	}
+
+	var gws []*net.IPNet
+	for _, r := range ranges {
+		gw := r.GetGateway()
+		if gw == nil {
+			return nil, nil, fmt.Errorf("can not get gw from subnet:%s", r.Subnet)
 		}
-		break
+		gws = append(gws, gw)
+	}
+
+	allocator := ipam.NewAllocator(ranges...)
+	allocator.Requested = requested
+	allocator.Quarantine = time.Duration(pluginConfig.IpQuarantine) * time.Second
+	podIPs, err := allocator.Allocate(&ipam.Attachment{
+		ContainerId:  args.ContainerID,
+		IfName:       args.IfName,
+		Network:      pluginConfig.Name,
+		Netns:        args.Netns,
+		PodNamespace: pluginConfig.K8sArgs.PodNamespace(),
+		PodName:      pluginConfig.K8sArgs.PodName(),
+	})
+	if err != nil {
+		return nil, nil, requestedIpError(err)
+	}
+	return podIPs, gws, nil
+}
+
+func Bootstrap(args *skel.CmdArgs, pluginConfig *PConf, containerId string) (result *types.Result, err error) {
+	br, err := nettools.GetBridge(pluginConfig.Bridge)
+	if err != nil {
+		return nil, fmt.Errorf("get bridge error:%s", err.Error())
 	}
 
+	//netns要在撤销操作之后才能关闭，所以Close的defer必须在rollback的defer之前注册
 	netNs, err := nettools.GetNetNs(args.Netns)
 	if err != nil {
 		return nil, err
 	}
+	defer (*netNs).Close()
 
-	gw := ipam.GetGateway(pluginConfig.Subnet)
-	if gw == nil {
-		return nil, fmt.Errorf("can not get gw from subnet:%s", pluginConfig.Subnet)
+	//内置分配器读取pod注解需要访问apiserver，放在拿锁之前
+	var requested []net.IP
+	var ranges []*ipam.Range
+	if !pluginConfig.delegatedIpam() {
+		requested, ranges, err = prepareAllocation(pluginConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		lock, err := lockIpam(pluginConfig)
+		if err != nil {
+			return nil, err
+		}
+		defer lock.Release()
 	}
 
-	br, err := nettools.GetBridge()
-	if err != nil {
-		return nil, fmt.Errorf("get bridge error:%s", err.Error())
+	//任何一步失败都要把之前做过的步骤逆序撤销掉
+	rb := &rollback{}
+	defer func() {
+		if err != nil {
+			rb.run()
+		}
+	}()
+
+	//每个ip和它的网关一一对应
+	var podIPs, gws []*net.IPNet
+	var ipamResult *types.Result
+	if pluginConfig.delegatedIpam() {
+		//ipam插件ADD失败时也可能已经分配了ip，先登记撤销操作
+		rb.add("release ip", func() error {
+			return delegateDel(args.StdinData, pluginConfig)
+		})
+		ipamResult, gws, err = delegateAdd(args.StdinData, pluginConfig, br)
+		if err != nil {
+			return nil, err
+		}
+		for _, ipc := range ipamResult.IPs {
+			address := ipc.Address
+			podIPs = append(podIPs, &address)
+		}
+	} else {
+		//在锁内分配ip，返回前预留记录已经落盘
+		podIPs, gws, err = allocateIps(args, pluginConfig, ranges, requested)
+		if err != nil {
+			return nil, err
+		}
+		rb.add("release ip", func() error {
+			return ipam.Release(containerId, args.IfName)
+		})
+	}
+
+	//ipam插件给出的其他路由，默认路由按网关添加
+	routes := extraRoutes(ipamResult, gws)
+
+	//撤销操作在宿主机的namespace中执行，涉及pod那头的需要重新进入netns
+	inPodNs := func(f func() error) func() error {
+		return func() error {
+			return (*netNs).Do(func(_ ns.NetNS) error {
+				return f()
+			})
+		}
+	}
+
+	//宿主机那头的veth按容器起名，同名的设备只可能是这个容器上一次ADD失败留下的
+	hostVethName := nettools.HostVethName(containerId, args.IfName)
+	if err = nettools.DelLinkByName(hostVethName); err != nil {
+		return nil, err
 	}
 
 	err = (*netNs).Do(func(hostNs ns.NetNS) error {
 		//创建一对veth设备
-		containerVeth, hostVeth, err := nettools.CreateVethPair(args.IfName, 1450)
+		containerVeth, hostVeth, err := nettools.CreateVethPair(args.IfName, hostVethName, pluginConfig.MTU)
 		if err != nil {
 			return fmt.Errorf("create veth error:%s", err.Error())
 		}
+		rb.add("delete container veth", inPodNs(func() error {
+			return nettools.DelLinkByName(args.IfName)
+		}))
 
-		//把随机起名的veth那头放在宿主机的namespace
+		//把veth那头放在宿主机的namespace
 		err = nettools.SetVethNsFd(hostVeth, hostNs)
 		if err != nil {
 			return fmt.Errorf("set veth to hostNs error:%s", err.Error())
 		}
+		rb.add("delete host veth", func() error {
+			return nettools.DelLinkByName(hostVethName)
+		})
 
-		//把要被放到pod中的那头veth塞上podIP
-		err = nettools.SetIpForVeth(containerVeth.Name, podIP.String())
-		if err != nil {
-			return fmt.Errorf("set ip to veth error:%s", err.Error())
+		//把要被放到pod中的那头veth塞上podIP，双栈时每个地址族一个
+		for _, podIP := range podIPs {
+			if podIP.IP.To4() == nil {
+				if err = nettools.EnableIPv6(containerVeth.Name); err != nil {
+					return err
+				}
+			}
+			err = nettools.SetIpForVeth(containerVeth.Name, podIP.String())
+			if err != nil {
+				return fmt.Errorf("set ip to veth error:%s", err.Error())
+			}
+			ipStr := podIP.String()
+			rb.add("delete ip from container veth", inPodNs(func() error {
+				return nettools.DelIpForVeth(args.IfName, ipStr)
+			}))
 		}
 
 		err = nettools.SetUpVeth(containerVeth)
@@ -90,21 +465,38 @@ func Bootstrap(args *skel.CmdArgs, pluginConfig *PConf, containerId string) (*ty
 			return fmt.Errorf("set up containerVeth error:%s", err.Error())
 		}
 
-		//创建默认路由
-		err = nettools.SetDefaultRouteToVeth(gw.IP, containerVeth)
-		if err != nil {
-			return fmt.Errorf("SetDefaultRouteToVeth error:%s", err.Error())
+		//创建默认路由，每个地址族一条
+		for _, gw := range gws {
+			err = nettools.SetDefaultRouteToVeth(gw.IP, containerVeth)
+			if err != nil {
+				return fmt.Errorf("SetDefaultRouteToVeth error:%s", err.Error())
+			}
+			gwIP := gw.IP
+			rb.add("delete default route", inPodNs(func() error {
+				return nettools.DelDefaultRouteToVeth(gwIP, containerVeth)
+			}))
+		}
+
+		for _, route := range routes {
+			err = nettools.AddRoute(&route.Dst, route.GW, containerVeth, 0)
+			if err != nil {
+				return fmt.Errorf("add route %s error:%s", route.String(), err.Error())
+			}
+			dst, gw := route.Dst, route.GW
+			rb.add("delete route", inPodNs(func() error {
+				return nettools.DelRoute(&dst, gw, containerVeth)
+			}))
 		}
 
-		_ = hostNs.Do(func(_ ns.NetNS) error {
+		return hostNs.Do(func(_ ns.NetNS) error {
 			//重新获取一次host上的veth，因为hostVeth发生了改变
-			_hostVeth, err := netlink.LinkByName(hostVeth.Attrs().Name)
+			_hostVeth, err := netlink.LinkByName(hostVethName)
 			if err != nil {
 				return fmt.Errorf("get hostVeth error:%s", err.Error())
 			}
 			var ok bool
 			if hostVeth, ok = _hostVeth.(*netlink.Veth); !ok {
-				return fmt.Errorf("%s not a veth device", hostVeth.Attrs().Name)
+				return fmt.Errorf("%s not a veth device", hostVethName)
 			}
 
 			err = nettools.SetUpVeth(hostVeth)
@@ -117,27 +509,28 @@ func Bootstrap(args *skel.CmdArgs, pluginConfig *PConf, containerId string) (*ty
 			if err != nil {
 				return fmt.Errorf("add hostVeth to bridge error:%s", err.Error())
 			}
+			rb.add("remove host veth from bridge", func() error {
+				return nettools.UnsetVethMaster(hostVeth)
+			})
 			return nil
 		})
-		return nil
 	})
-	//ip地址占位
-	err = utils.CreateFile(fmt.Sprintf("%s/%s", ipam.IpStoragePath, podIP.IP.String()), nil, 0766)
 	if err != nil {
-		utils.WriteLog("create ip file error:", err.Error())
-	}
-	err = utils.CreateFile(fmt.Sprintf("%s/%s", ipam.ContainerIdStoragePath, containerId), []byte(podIP.IP.String()), 0766)
-	if err != nil {
-		utils.WriteLog("create containerId file error:", err.Error())
+		return nil, err
 	}
-	result := &types.Result{
+
+	result = &types.Result{
 		CNIVersion: pluginConfig.CNIVersion,
-		IPs: []*types.IPConfig{
-			{
-				Address: *podIP,
-				Gateway: gw.IP,
-			},
-		},
+	}
+	for i, podIP := range podIPs {
+		result.IPs = append(result.IPs, &types.IPConfig{
+			Address: *podIP,
+			Gateway: gws[i].IP,
+		})
+	}
+	if ipamResult != nil {
+		result.Routes = routes
+		result.DNS = ipamResult.DNS
 	}
 	return result, nil
 }
@@ -0,0 +1,178 @@
+package plugin
+
+import (
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/vishvananda/netlink"
+	"net"
+	"os"
+	"strings"
+	"test-cni/ipam"
+	"test-cni/nettools"
+	"test-cni/skel"
+	"test-cni/utils"
+	"testing"
+)
+
+// useTempState 把ip存储、锁文件和日志都放到临时目录，不影响本机的插件
+func useTempState(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	oldIp, oldAttachment := ipam.IpStoragePath, ipam.AttachmentStoragePath
+	oldLastReserved, oldReleased := ipam.LastReservedStoragePath, ipam.ReleasedStoragePath
+	ipam.IpStoragePath = dir + "/ips"
+	ipam.AttachmentStoragePath = dir + "/attachments"
+	ipam.LastReservedStoragePath = dir + "/last_reserved"
+	ipam.ReleasedStoragePath = dir + "/released"
+	t.Cleanup(func() {
+		ipam.IpStoragePath, ipam.AttachmentStoragePath = oldIp, oldAttachment
+		ipam.LastReservedStoragePath, ipam.ReleasedStoragePath = oldLastReserved, oldReleased
+	})
+	ipam.InitStorage()
+	utils.SetLockPath(dir + "/cni.lock")
+	logPath := dir + "/test-cni.log"
+	utils.InitLog(&utils.LogConfig{Path: logPath})
+	return logPath
+}
+
+func newTestNS(t *testing.T) ns.NetNS {
+	t.Helper()
+	netNs, err := testutils.NewNS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = netNs.Close()
+		_ = testutils.UnmountNS(netNs)
+	})
+	return netNs
+}
+
+// TestBootstrapRollbackInPodNs 在pod的netns里失败时，撤销操作要在netns关闭之前执行，veth不能留下
+func TestBootstrapRollbackInPodNs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("need root to create network namespaces")
+	}
+	logPath := useTempState(t)
+	hostNs, podNs := newTestNS(t), newTestNS(t)
+
+	err := hostNs.Do(func(_ ns.NetNS) error {
+		return netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "testbr0"}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//pod里已经有一条默认路由，ADD添加默认路由时会失败
+	err = podNs.Do(func(_ ns.NetNS) error {
+		lan := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "lan0"}}
+		if err := netlink.LinkAdd(lan); err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(lan); err != nil {
+			return err
+		}
+		if err := nettools.SetIpForVeth("lan0", "192.168.200.2/24"); err != nil {
+			return err
+		}
+		return nettools.AddRoute(nil, net.ParseIP("192.168.200.1"), lan, 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := &skel.CmdArgs{
+		ContainerID: "rollback-test",
+		Netns:       podNs.Path(),
+		IfName:      "eth0",
+		StdinData:   []byte(`{"cniVersion":"1.0.0","name":"testcni","type":"testcni","subnet":"10.244.0.0/24","bridge":"testbr0"}`),
+	}
+	pluginConfig := GetConfigs(args)
+	if pluginConfig == nil {
+		t.Fatal("GetConfigs() returned nil")
+	}
+	err = hostNs.Do(func(_ ns.NetNS) error {
+		_, err := Bootstrap(args, pluginConfig, args.ContainerID)
+		return err
+	})
+	if err == nil || !strings.Contains(err.Error(), "SetDefaultRouteToVeth") {
+		t.Fatalf("Bootstrap() error = %v, want SetDefaultRouteToVeth error", err)
+	}
+
+	err = podNs.Do(func(_ ns.NetNS) error {
+		if _, err := netlink.LinkByName(args.IfName); !nettools.IsLinkNotFound(err) {
+			t.Errorf("%s still exists in pod netns, error:%v", args.IfName, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostVethName := nettools.HostVethName(args.ContainerID, args.IfName)
+	err = hostNs.Do(func(_ ns.NetNS) error {
+		if _, err := netlink.LinkByName(hostVethName); !nettools.IsLinkNotFound(err) {
+			t.Errorf("%s still exists in host netns, error:%v", hostVethName, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ipam.GetAttachment(args.ContainerID, args.IfName); !os.IsNotExist(err) {
+		t.Errorf("attachment of %s still exists, error:%v", args.ContainerID, err)
+	}
+	//每一步撤销都要成功，pod那头的步骤不能因为netns已经关闭而失败
+	b, err := os.ReadFile(logPath)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "rollback error") {
+		t.Errorf("rollback failed:\n%s", b)
+	}
+}
+
+// TestLoadConfigBadCniArgs CNI_ARGS解析失败时配置照常返回，ADD只在需要pod信息时报错
+func TestLoadConfigBadCniArgs(t *testing.T) {
+	useTempState(t)
+	const conf = `{"cniVersion":"1.0.0","name":"testcni","type":"testcni","subnet":"10.244.0.0/24"}`
+	const poolConf = `{"cniVersion":"1.0.0","name":"testcni","type":"testcni","subnet":"10.244.0.0/24",` +
+		`"pools":[{"name":"db","namespaces":["db"],"ranges":[{"subnet":"10.245.0.0/24"}]}]}`
+	cases := []struct {
+		name      string
+		conf      string
+		args      string
+		requested string
+		err       string
+	}{
+		{"unknown key", conf, "K8S_POD_NAMESPACE=default;K8S_POD_NAME=web;FOO=bar", "", ""},
+		{"invalid pair", conf, "K8S_POD_NAMESPACE", "", ""},
+		{"unknown key with requested ip", conf, "FOO=bar;IP=10.244.0.5", "", "parse CNI_ARGS"},
+		{"unknown key with pools", poolConf, "K8S_POD_NAMESPACE=db;FOO=bar", "", "parse CNI_ARGS"},
+		{"ignore unknown", conf, "IgnoreUnknown=1;FOO=bar;IP=10.244.0.5", "10.244.0.5", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			args := &skel.CmdArgs{ContainerID: "args-test", IfName: "eth0", Args: c.args, StdinData: []byte(c.conf)}
+			pluginConfig := GetConfigs(args)
+			if pluginConfig == nil {
+				t.Fatal("GetConfigs() returned nil")
+			}
+			requested, _, err := prepareAllocation(pluginConfig)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("prepareAllocation() error = %v, want %q", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("prepareAllocation() error = %v", err)
+			}
+			var got []string
+			for _, ip := range requested {
+				got = append(got, ip.String())
+			}
+			if strings.Join(got, ",") != c.requested {
+				t.Fatalf("prepareAllocation() requested = %v, want %s", got, c.requested)
+			}
+		})
+	}
+}
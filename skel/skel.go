@@ -64,9 +64,11 @@ func (t *dispatcher) getCmdArgsFromEnv() (string, *CmdArgs, *types.Error) {
 			"CNI_COMMAND",
 			&cmd,
 			reqForCmdEntry{
-				"ADD":   true,
-				"CHECK": true,
-				"DEL":   true,
+				"ADD":    true,
+				"CHECK":  true,
+				"DEL":    true,
+				"GC":     true,
+				"STATUS": true,
 			},
 		},
 		{
@@ -109,9 +111,11 @@ func (t *dispatcher) getCmdArgsFromEnv() (string, *CmdArgs, *types.Error) {
 			"CNI_PATH",
 			&path,
 			reqForCmdEntry{
-				"ADD":   true,
-				"CHECK": true,
-				"DEL":   true,
+				"ADD":    true,
+				"CHECK":  true,
+				"DEL":    true,
+				"GC":     true,
+				"STATUS": true,
 			},
 		},
 	}
@@ -188,7 +192,29 @@ func validateConfig(jsonBytes []byte) *types.Error {
 	return nil
 }
 
-func (t *dispatcher) pluginMain(cmdAdd, cmdCheck, cmdDel func(_ *CmdArgs) error, versionInfo version.PluginInfo, about string) *types.Error {
+// checkVersionAtLeast 确认配置的版本不低于minVersion，并且插件支持这个版本
+func (t *dispatcher) checkVersionAtLeast(cmd string, cmdArgs *CmdArgs, versionInfo version.PluginInfo, minVersion string) *types.Error {
+	configVersion, err := t.ConfVersionDecoder.Decode(cmdArgs.StdinData)
+	if err != nil {
+		return types.NewError(types.ErrDecodingFailure, err.Error(), "")
+	}
+	if gtet, err := version.GreaterThanOrEqualTo(configVersion, minVersion); err != nil {
+		return types.NewError(types.ErrDecodingFailure, err.Error(), "")
+	} else if !gtet {
+		return types.NewError(types.ErrIncompatibleCNIVersion, fmt.Sprintf("config version does not allow %s", cmd), "")
+	}
+	for _, pluginVersion := range versionInfo.SupportedVersions() {
+		gtet, err := version.GreaterThanOrEqualTo(pluginVersion, configVersion)
+		if err != nil {
+			return types.NewError(types.ErrDecodingFailure, err.Error(), "")
+		} else if gtet {
+			return nil
+		}
+	}
+	return types.NewError(types.ErrIncompatibleCNIVersion, fmt.Sprintf("plugin version does not allow %s", cmd), "")
+}
+
+func (t *dispatcher) pluginMain(funcs CNIFuncs, versionInfo version.PluginInfo, about string) *types.Error {
 	cmd, cmdArgs, err := t.getCmdArgsFromEnv()
 	if err != nil {
 		if err.Code == types.ErrInvalidEnvironmentVariables && t.Getenv("CNI_COMMAND") == "" && about != "" {
@@ -201,6 +227,9 @@ func (t *dispatcher) pluginMain(cmdAdd, cmdCheck, cmdDel func(_ *CmdArgs) error,
 		if err = validateConfig(cmdArgs.StdinData); err != nil {
 			return err
 		}
+	}
+	//GC和STATUS是针对整个网络的，没有容器id和网卡名
+	if cmd == "ADD" || cmd == "CHECK" || cmd == "DEL" {
 		if err = utils.ValidateContainerID(cmdArgs.ContainerID); err != nil {
 			return err
 		}
@@ -211,11 +240,27 @@ func (t *dispatcher) pluginMain(cmdAdd, cmdCheck, cmdDel func(_ *CmdArgs) error,
 
 	switch cmd {
 	case "ADD":
-		err = t.checkVersionAndCall(cmdArgs, versionInfo, cmdAdd)
+		err = t.checkVersionAndCall(cmdArgs, versionInfo, funcs.Add)
 	case "CHECK":
-		return nil
+		if err = t.checkVersionAtLeast(cmd, cmdArgs, versionInfo, "0.4.0"); err != nil {
+			return err
+		}
+		err = t.checkVersionAndCall(cmdArgs, versionInfo, funcs.Check)
 	case "DEL":
-		err = t.checkVersionAndCall(cmdArgs, versionInfo, cmdDel)
+		err = t.checkVersionAndCall(cmdArgs, versionInfo, funcs.Del)
+	case "GC", "STATUS":
+		toCall := funcs.GC
+		if cmd == "STATUS" {
+			toCall = funcs.Status
+		}
+		if err = t.checkVersionAtLeast(cmd, cmdArgs, versionInfo, "1.1.0"); err != nil {
+			return err
+		}
+		//没有实现的插件按规范视为成功
+		if toCall == nil {
+			return nil
+		}
+		err = t.checkVersionAndCall(cmdArgs, versionInfo, toCall)
 	case "VERSION":
 		if err := versionInfo.Encode(t.Stdout); err != nil {
 			return types.NewError(types.ErrIOFailure, err.Error(), "")
@@ -226,20 +271,37 @@ func (t *dispatcher) pluginMain(cmdAdd, cmdCheck, cmdDel func(_ *CmdArgs) error,
 	return err
 }
 
-func PluginMainWithError(cmdAdd, cmdCheck, cmdDel func(_ *CmdArgs) error, versionInfo version.PluginInfo, about string) *types.Error {
+// CNIFuncs 插件实现的各个命令，GC和Status可以为空
+type CNIFuncs struct {
+	Add    func(_ *CmdArgs) error
+	Del    func(_ *CmdArgs) error
+	Check  func(_ *CmdArgs) error
+	GC     func(_ *CmdArgs) error
+	Status func(_ *CmdArgs) error
+}
+
+func PluginMainFuncsWithError(funcs CNIFuncs, versionInfo version.PluginInfo, about string) *types.Error {
 	return (&dispatcher{
 		Getenv: os.Getenv,
 		Stdin:  os.Stdin,
 		Stdout: os.Stdout,
 		Stderr: os.Stderr,
-	}).pluginMain(cmdAdd, cmdCheck, cmdDel, versionInfo, about)
+	}).pluginMain(funcs, versionInfo, about)
 }
 
-func PluginMain(cmdAdd, cmdCheck, cmdDel func(_ *CmdArgs) error, versionInfo version.PluginInfo, about string) {
-	if e := PluginMainWithError(cmdAdd, cmdCheck, cmdDel, versionInfo, about); e != nil {
+func PluginMainFuncs(funcs CNIFuncs, versionInfo version.PluginInfo, about string) {
+	if e := PluginMainFuncsWithError(funcs, versionInfo, about); e != nil {
 		if err := e.Print(); err != nil {
-			lutils.WriteLog("Error writing error JSON to stdout: ", err.Error())
+			lutils.LogError("Error writing error JSON to stdout", "error", err.Error())
 		}
 		os.Exit(1)
 	}
 }
+
+func PluginMainWithError(cmdAdd, cmdCheck, cmdDel func(_ *CmdArgs) error, versionInfo version.PluginInfo, about string) *types.Error {
+	return PluginMainFuncsWithError(CNIFuncs{Add: cmdAdd, Check: cmdCheck, Del: cmdDel}, versionInfo, about)
+}
+
+func PluginMain(cmdAdd, cmdCheck, cmdDel func(_ *CmdArgs) error, versionInfo version.PluginInfo, about string) {
+	PluginMainFuncs(CNIFuncs{Add: cmdAdd, Check: cmdCheck, Del: cmdDel}, versionInfo, about)
+}
@@ -0,0 +1,192 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultLogPath       = "/root/test-cni.log"
+	defaultLogMaxSize    = 10
+	defaultLogMaxBackups = 5
+)
+
+// LogConfig 日志配置，对应插件配置中的log字段
+type LogConfig struct {
+	Path  string `json:"path"`
+	Level string `json:"level"`
+	//单个日志文件的最大大小，单位MB
+	MaxSize int `json:"maxSize"`
+	//保留的历史日志文件个数
+	MaxBackups int `json:"maxBackups"`
+}
+
+var (
+	//没有配置path时使用的日志文件，每个二进制各用一个
+	logDefaultPath = defaultLogPath
+	logMu          sync.Mutex
+	logger         *slog.Logger
+	logWriter      *rotateWriter
+	logLevel       = new(slog.LevelVar)
+	logFields      []any
+)
+
+// InitLog 按配置重新初始化日志，conf为nil时使用默认配置
+func InitLog(conf *LogConfig) {
+	c := LogConfig{}
+	if conf != nil {
+		c = *conf
+	}
+	if c.Path == "" {
+		c.Path = logDefaultPath
+	}
+	if c.MaxSize <= 0 {
+		c.MaxSize = defaultLogMaxSize
+	}
+	if c.MaxBackups <= 0 {
+		c.MaxBackups = defaultLogMaxBackups
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	if logWriter != nil {
+		logWriter.Close()
+	}
+	logLevel.Set(parseLevel(c.Level))
+	logWriter = &rotateWriter{path: c.Path, maxSize: int64(c.MaxSize) << 20, maxBackups: c.MaxBackups}
+	logger = slog.New(slog.NewJSONHandler(logWriter, &slog.HandlerOptions{Level: logLevel})).With(logFields...)
+}
+
+// SetDefaultLogPath 修改没有配置path时使用的日志文件，要在输出第一条日志之前调用
+func SetDefaultLogPath(path string) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	logDefaultPath = path
+}
+
+// SetLogFields 设置之后每条日志都会带上的字段，比如command、containerID、netns、ifName
+func SetLogFields(args ...any) {
+	getLogger()
+	logMu.Lock()
+	defer logMu.Unlock()
+	logFields = append(logFields, args...)
+	logger = logger.With(args...)
+}
+
+func getLogger() *slog.Logger {
+	logMu.Lock()
+	l := logger
+	logMu.Unlock()
+	if l == nil {
+		InitLog(nil)
+		logMu.Lock()
+		l = logger
+		logMu.Unlock()
+	}
+	return l
+}
+
+func parseLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+func LogDebug(msg string, args ...any) {
+	getLogger().Log(context.Background(), slog.LevelDebug, msg, args...)
+}
+
+func LogInfo(msg string, args ...any) {
+	getLogger().Log(context.Background(), slog.LevelInfo, msg, args...)
+}
+
+func LogWarn(msg string, args ...any) {
+	getLogger().Log(context.Background(), slog.LevelWarn, msg, args...)
+}
+
+func LogError(msg string, args ...any) {
+	getLogger().Log(context.Background(), slog.LevelError, msg, args...)
+}
+
+// WriteLog 兼容旧的调用方式，按info级别输出
+func WriteLog(log ...string) {
+	LogInfo(strings.Join(log, " "))
+}
+
+// rotateWriter 超过maxSize时把当前文件依次改名为.1、.2...，最多保留maxBackups个
+type rotateWriter struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func (w *rotateWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+	if w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotateWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = info.Size()
+	return nil
+}
+
+func (w *rotateWriter) rotate() error {
+	w.file.Close()
+	w.file = nil
+	//插件是多进程并发写的，别的进程可能已经轮转过了，重新看一下文件大小
+	if info, err := os.Stat(w.path); err == nil && info.Size() < w.maxSize {
+		return w.open()
+	}
+	_ = os.Remove(fmt.Sprintf("%s.%d", w.path, w.maxBackups))
+	for i := w.maxBackups - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+	}
+	_ = os.Rename(w.path, w.path+".1")
+	return w.open()
+}
+
+func (w *rotateWriter) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+}
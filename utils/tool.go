@@ -1,32 +1,23 @@
 package utils
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
-var lockPath = "/root/cni_lock_dir"
-var logPath = "/root/test-cni.log"
+var lockPath = "/root/cni.lock"
 
-func WriteLog(log ...string) {
-	file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
-		file, _ = os.Create(logPath)
-	}
-	defer file.Close()
-	write := bufio.NewWriter(file)
-	logRes := ""
-	for _, c := range log {
-		logRes += c
-		logRes += " "
-	}
-	_, _ = write.WriteString(time.Now().Format("2006-01-02 15:04:05") + ": " + logRes + "\r\n")
-	write.Flush()
+// SetLockPath 修改ipam锁文件的路径，要在第一次AcquireLock之前调用
+func SetLockPath(path string) {
+	lockPath = path
 }
 
 func CreateDir(dirName string) error {
@@ -53,6 +44,32 @@ func CreateFile(filename string, data []byte, perm os.FileMode) error {
 	return nil
 }
 
+// WriteFileAtomic 先写临时文件再rename，保证文件要么是旧内容要么是完整的新内容
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	dir, base := filepath.Split(filename)
+	f, err := os.CreateTemp(dir, "."+base+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	defer os.Remove(tmpName)
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmpName, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, filename)
+}
+
 func FileIsExisted(filename string) bool {
 	existed := true
 	if _, err := os.Stat(filename); os.IsNotExist(err) {
@@ -103,22 +120,79 @@ func CopyFile(src, dst string) error {
 	return err
 }
 
-func AcquireLock() (bool, error) {
-	err := os.Mkdir(lockPath, 0766)
+// LockTimeoutError 在超时时间内没能拿到锁时返回，带上当前持有者的pid便于排查
+type LockTimeoutError struct {
+	Path        string
+	Timeout     time.Duration
+	HolderPid   int
+	HolderAlive bool
+}
+
+func (e *LockTimeoutError) Error() string {
+	return fmt.Sprintf("acquire lock %s timeout after %s, holder pid:%d alive:%t", e.Path, e.Timeout, e.HolderPid, e.HolderAlive)
+}
+
+// FileLock 基于flock(2)的文件锁，进程退出时内核会自动释放，不会残留
+type FileLock struct {
+	file *os.File
+}
+
+func AcquireLock(timeout time.Duration) (*FileLock, error) {
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
-		var e *os.PathError
-		errors.As(err, &e)
-		if e.Err.Error() == "file exists" {
-			return false, nil
+		return nil, fmt.Errorf("open lock file %s error:%s", lockPath, err.Error())
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			return nil, fmt.Errorf("flock %s error:%s", lockPath, err.Error())
+		}
+		if time.Now().After(deadline) {
+			pid := readLockHolder(f)
+			f.Close()
+			return nil, &LockTimeoutError{
+				Path:        lockPath,
+				Timeout:     timeout,
+				HolderPid:   pid,
+				HolderAlive: pid > 0 && syscall.Kill(pid, 0) == nil,
+			}
 		}
-		return false, err
+		time.Sleep(50 * time.Millisecond)
 	}
-	return true, nil
+
+	//记录持有者的pid，只用于排查问题，锁本身不依赖它
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	}
+	if err != nil {
+		LogWarn("write lock holder pid error", "error", err.Error())
+	}
+	return &FileLock{file: f}, nil
 }
 
-func ReleaseLock() {
-	err := os.RemoveAll(lockPath)
+func readLockHolder(f *os.File) int {
+	b := make([]byte, 32)
+	n, _ := f.ReadAt(b, 0)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b[:n])))
 	if err != nil {
-		WriteLog("release lock error:", err.Error())
+		return 0
+	}
+	return pid
+}
+
+func (l *FileLock) Release() {
+	if l == nil || l.file == nil {
+		return
+	}
+	_ = l.file.Truncate(0)
+	if err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN); err != nil {
+		LogError("release lock error", "error", err.Error())
 	}
+	_ = l.file.Close()
+	l.file = nil
 }